@@ -0,0 +1,252 @@
+package alerts
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/snmp"
+	"go.uber.org/zap"
+)
+
+const (
+	StatusOpen     = "open"
+	StatusResolved = "resolved"
+)
+
+// Notifier delivers opened and resolved alerts.
+type Notifier interface {
+	Notify(alert *models.Alert)
+}
+
+type alertState struct {
+	breaches int
+	alert    *models.Alert
+	// interface of an interface rule, its alert is resolved when the
+	// interface disappears
+	deviceID int32
+	ifIndex  int
+	iface    bool
+}
+
+// Engine evaluates rules on every poll. An alert is opened once, repeated
+// matches of an open alert are not sent again until it is resolved.
+type Engine struct {
+	logger   *zap.Logger
+	rules    []Rule
+	notifier Notifier
+
+	lock   sync.Mutex
+	states map[string]*alertState
+	// last oper status of every interface by device id and ifIndex
+	operUp map[int32]map[int]bool
+}
+
+func NewEngine(logger *zap.Logger, rules []Rule, notifier Notifier) *Engine {
+	return &Engine{
+		logger:   logger,
+		rules:    rules,
+		notifier: notifier,
+		states:   map[string]*alertState{},
+		operUp:   map[int32]map[int]bool{},
+	}
+}
+
+// Evaluate is a decorator which evaluates interface rules, it must run
+// after rates are set.
+func (e *Engine) Evaluate(decorator snmp.DecorateFunc) snmp.DecorateFunc {
+	return func(metricsMap *models.SnmpInterfaceMetrics) error {
+		e.EvaluateMetrics(metricsMap)
+		return decorator(metricsMap)
+	}
+}
+
+// EvaluateMetrics evaluates interface rules on a polled device, polls
+// without counters have no interface state and are ignored.
+func (e *Engine) EvaluateMetrics(metrics *models.SnmpInterfaceMetrics) {
+	if !metrics.Collected(snmp.CollectorCounters) {
+		return
+	}
+	now := time.Now().UTC().Unix()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for _, rule := range e.rules {
+		if rule.Type == RuleDeviceUnreachable || !rule.appliesTo(metrics.DeviceID) {
+			continue
+		}
+		for ifIndex, iface := range metrics.CountersMap {
+			value, breached, known := e.interfaceCondition(rule, metrics.DeviceID, ifIndex, iface)
+			if !known {
+				continue
+			}
+			alert := &models.Alert{
+				Key:         fmt.Sprintf("%s|%d|%d", rule.Name, metrics.DeviceID, ifIndex),
+				DeviceID:    metrics.DeviceID,
+				PollerGroup: metrics.PollerGroup,
+				Hostname:    metrics.Hostname,
+				SysName:     metrics.SysName,
+				IfIndex:     ifIndex,
+				IfName:      iface.IfName,
+				Value:       value,
+				Threshold:   rule.Threshold,
+			}
+			e.transition(now, rule, alert, breached)
+		}
+	}
+
+	// interfaces which are gone never come back to resolve their alerts
+	for key, state := range e.states {
+		if !state.iface || state.deviceID != metrics.DeviceID {
+			continue
+		}
+		if _, ok := metrics.CountersMap[state.ifIndex]; !ok {
+			e.resolve(now, key, state, 0)
+		}
+	}
+	operUp := make(map[int]bool, len(metrics.CountersMap))
+	for ifIndex, iface := range metrics.CountersMap {
+		operUp[ifIndex] = iface.OperStatus
+	}
+	e.operUp[metrics.DeviceID] = operUp
+}
+
+// EvaluateAvailability evaluates device rules on a reachability sample.
+func (e *Engine) EvaluateAvailability(sample *models.DeviceAvailability) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for _, rule := range e.rules {
+		if rule.Type != RuleDeviceUnreachable || !rule.appliesTo(sample.DeviceID) {
+			continue
+		}
+		alert := &models.Alert{
+			Key:         fmt.Sprintf("%s|%d", rule.Name, sample.DeviceID),
+			DeviceID:    sample.DeviceID,
+			PollerGroup: sample.PollerGroup,
+			Hostname:    sample.Hostname,
+			SysName:     sample.SysName,
+		}
+		if !sample.Reachable {
+			alert.Value = 1
+		}
+		e.transition(sample.Time, rule, alert, !sample.Reachable)
+	}
+}
+
+// interfaceCondition returns the value the rule is checked against and if
+// it matched, known is false when the value can't be computed this poll,
+// e.g. there are no rates yet, so the alert state is left as it is.
+func (e *Engine) interfaceCondition(rule Rule, deviceID int32, ifIndex int, iface models.SnmpInterface) (float64, bool, bool) {
+	switch rule.Type {
+	case RuleOperDown:
+		wasUp, ok := e.operUp[deviceID][ifIndex]
+		if !ok {
+			return 0, false, false
+		}
+		_, open := e.states[fmt.Sprintf("%s|%d|%d", rule.Name, deviceID, ifIndex)]
+		down := iface.AdminStatus && !iface.OperStatus
+		if !down {
+			return 0, false, true
+		}
+		// interfaces which were never up are unused ports
+		return 1, wasUp || open, true
+	case RuleUtilisation:
+		speed := ifSpeed(iface)
+		if iface.Rates == nil || speed <= 0 {
+			return 0, false, false
+		}
+		bps := iface.Rates["in_bps"]
+		if out := iface.Rates["out_bps"]; out > bps {
+			bps = out
+		}
+		value := bps / speed * 100
+		return value, value > rule.Threshold, true
+	case RuleErrorRate:
+		if iface.Rates == nil {
+			return 0, false, false
+		}
+		value := iface.Rates["in_errors_rate"] + iface.Rates["out_errors_rate"]
+		return value, value > rule.Threshold, true
+	}
+	return 0, false, false
+}
+
+// ifSpeed is bits per second, ifSpeed saturates at 4.2Gbps so ifHighSpeed
+// in Mbps is preferred.
+func ifSpeed(iface models.SnmpInterface) float64 {
+	if high, ok := iface.Counters["ifHighSpeed"]; ok && high != nil && high.Sign() > 0 {
+		return float64(high.Int64()) * 1e6
+	}
+	return float64(iface.Speed)
+}
+
+// transition counts consecutive breaches and opens or resolves the alert.
+func (e *Engine) transition(now int64, rule Rule, alert *models.Alert, breached bool) {
+	state, ok := e.states[alert.Key]
+	if !breached {
+		if ok {
+			e.resolve(now, alert.Key, state, alert.Value)
+		}
+		return
+	}
+
+	if !ok {
+		state = &alertState{
+			deviceID: alert.DeviceID,
+			ifIndex:  alert.IfIndex,
+			iface:    rule.Type != RuleDeviceUnreachable,
+		}
+		e.states[alert.Key] = state
+	}
+	state.breaches++
+	if state.alert != nil || state.breaches < rule.Polls {
+		return
+	}
+
+	alert.Rule = rule.Name
+	alert.Type = rule.Type
+	alert.Severity = rule.Severity
+	alert.Status = StatusOpen
+	alert.OpenedAt = now
+	alert.Message = message(rule, alert)
+	state.alert = alert
+	e.logger.Info("alert opened", zap.String("rule", rule.Name), zap.Int32("device_id", alert.DeviceID), zap.Int("if_index", alert.IfIndex), zap.Float64("value", alert.Value))
+	opened := *alert
+	e.notifier.Notify(&opened)
+}
+
+// resolve forgets the state and notifies if its alert was opened.
+func (e *Engine) resolve(now int64, key string, state *alertState, value float64) {
+	delete(e.states, key)
+	if state.alert == nil {
+		return
+	}
+	resolved := *state.alert
+	resolved.Status = StatusResolved
+	resolved.Value = value
+	resolved.ResolvedAt = now
+	resolved.Message = "resolved: " + state.alert.Message
+	e.logger.Info("alert resolved", zap.String("rule", resolved.Rule), zap.Int32("device_id", resolved.DeviceID), zap.Int("if_index", resolved.IfIndex))
+	e.notifier.Notify(&resolved)
+}
+
+func message(rule Rule, alert *models.Alert) string {
+	device := alert.SysName
+	if device == "" {
+		device = alert.Hostname
+	}
+	switch rule.Type {
+	case RuleOperDown:
+		return fmt.Sprintf("%s %s is down", device, alert.IfName)
+	case RuleUtilisation:
+		return fmt.Sprintf("%s %s utilisation %.1f%% above %.1f%%", device, alert.IfName, alert.Value, rule.Threshold)
+	case RuleErrorRate:
+		return fmt.Sprintf("%s %s errors %.2f/s above %.2f/s", device, alert.IfName, alert.Value, rule.Threshold)
+	case RuleDeviceUnreachable:
+		return fmt.Sprintf("%s is unreachable", device)
+	}
+	return rule.Name
+}
@@ -0,0 +1,111 @@
+package alerts
+
+import (
+	"testing"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/snmp"
+	"go.uber.org/zap"
+)
+
+type recorder struct {
+	alerts []*models.Alert
+}
+
+func (r *recorder) Notify(alert *models.Alert) {
+	r.alerts = append(r.alerts, alert)
+}
+
+func poll(deviceID int32, ifaces map[int]models.SnmpInterface) *models.SnmpInterfaceMetrics {
+	return &models.SnmpInterfaceMetrics{
+		DeviceID:    deviceID,
+		SysName:     "router1",
+		CountersMap: ifaces,
+		Collectors:  []models.CollectorResult{{Name: snmp.CollectorCounters, Status: snmp.CollectorOk}},
+	}
+}
+
+func utilised(percent float64) models.SnmpInterface {
+	return models.SnmpInterface{
+		IfName:      "xe-0/0/0",
+		AdminStatus: true,
+		OperStatus:  true,
+		Speed:       1e9,
+		Rates:       map[string]float64{"in_bps": percent * 1e7, "out_bps": 0},
+	}
+}
+
+func TestEngineOpensAndResolves(t *testing.T) {
+	notifier := &recorder{}
+	rules := []Rule{{Name: "busy", Type: RuleUtilisation, Threshold: 80, Polls: 2}}
+	engine := NewEngine(zap.NewNop(), rules, notifier)
+
+	steps := []struct {
+		percent float64
+		status  string
+	}{
+		{90, ""},
+		{95, StatusOpen},
+		{99, ""},
+		{97, ""},
+		{10, StatusResolved},
+		{10, ""},
+	}
+	for i, step := range steps {
+		sent := len(notifier.alerts)
+		engine.EvaluateMetrics(poll(1, map[int]models.SnmpInterface{5: utilised(step.percent)}))
+		if step.status == "" {
+			if len(notifier.alerts) != sent {
+				t.Fatalf("poll %d: unexpected alert %+v", i, notifier.alerts[sent])
+			}
+			continue
+		}
+		if len(notifier.alerts) != sent+1 {
+			t.Fatalf("poll %d: want a %s alert, got %d alerts", i, step.status, len(notifier.alerts)-sent)
+		}
+		alert := notifier.alerts[sent]
+		if alert.Status != step.status || alert.Rule != "busy" || alert.DeviceID != 1 || alert.IfIndex != 5 {
+			t.Fatalf("poll %d: unexpected alert %+v", i, alert)
+		}
+	}
+}
+
+func TestEngineDeduplicates(t *testing.T) {
+	notifier := &recorder{}
+	rules := []Rule{{Name: "unreachable", Type: RuleDeviceUnreachable, Polls: 1}}
+	engine := NewEngine(zap.NewNop(), rules, notifier)
+
+	for i := 0; i < 5; i++ {
+		engine.EvaluateAvailability(&models.DeviceAvailability{DeviceID: 7, Time: int64(i)})
+	}
+	if len(notifier.alerts) != 1 || notifier.alerts[0].Status != StatusOpen {
+		t.Fatalf("want one open alert, got %+v", notifier.alerts)
+	}
+
+	engine.EvaluateAvailability(&models.DeviceAvailability{DeviceID: 7, Reachable: true})
+	engine.EvaluateAvailability(&models.DeviceAvailability{DeviceID: 7, Reachable: true})
+	if len(notifier.alerts) != 2 || notifier.alerts[1].Status != StatusResolved {
+		t.Fatalf("want the alert resolved once, got %+v", notifier.alerts)
+	}
+}
+
+func TestEngineResolvesRemovedInterface(t *testing.T) {
+	notifier := &recorder{}
+	rules := []Rule{{Name: "busy", Type: RuleUtilisation, Threshold: 80, Polls: 1}}
+	engine := NewEngine(zap.NewNop(), rules, notifier)
+
+	engine.EvaluateMetrics(poll(1, map[int]models.SnmpInterface{5: utilised(90), 6: utilised(10)}))
+	// another device's poll does not touch the alert
+	engine.EvaluateMetrics(poll(2, map[int]models.SnmpInterface{6: utilised(10)}))
+	if len(notifier.alerts) != 1 || notifier.alerts[0].Status != StatusOpen {
+		t.Fatalf("want one open alert, got %+v", notifier.alerts)
+	}
+
+	engine.EvaluateMetrics(poll(1, map[int]models.SnmpInterface{6: utilised(10)}))
+	if len(notifier.alerts) != 2 || notifier.alerts[1].Status != StatusResolved || notifier.alerts[1].IfIndex != 5 {
+		t.Fatalf("want the alert of the removed interface resolved, got %+v", notifier.alerts)
+	}
+	if len(engine.states) != 0 {
+		t.Fatalf("want no alert state left, got %d", len(engine.states))
+	}
+}
@@ -0,0 +1,80 @@
+package alerts
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const (
+	// RuleOperDown opens when an interface which was up goes down while
+	// admin up, it resolves when the interface is up again.
+	RuleOperDown = "oper_down"
+	// RuleUtilisation is the highest of in and out bps in percent of the
+	// interface speed.
+	RuleUtilisation = "utilisation"
+	// RuleErrorRate is in and out errors per second.
+	RuleErrorRate = "error_rate"
+	// RuleDeviceUnreachable is a device which did not answer a poll.
+	RuleDeviceUnreachable = "device_unreachable"
+)
+
+// Rule opens an alert when its condition is true for Polls consecutive
+// polls and resolves it on the first poll the condition is false.
+type Rule struct {
+	Name      string  `json:"name"`
+	Type      string  `json:"type"`
+	Threshold float64 `json:"threshold"`
+	Polls     int     `json:"polls"`
+	Severity  string  `json:"severity"`
+	// DeviceIDs limits the rule to these devices, all devices if empty
+	DeviceIDs []int32 `json:"device_ids"`
+}
+
+func (r Rule) appliesTo(deviceID int32) bool {
+	if len(r.DeviceIDs) == 0 {
+		return true
+	}
+	for _, id := range r.DeviceIDs {
+		if id == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadRules reads a JSON array of rules.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse alert rules %s: %w", path, err)
+	}
+
+	names := map[string]bool{}
+	for i := range rules {
+		rule := &rules[i]
+		switch rule.Type {
+		case RuleOperDown, RuleUtilisation, RuleErrorRate, RuleDeviceUnreachable:
+		default:
+			return nil, fmt.Errorf("alert rule %q: unknown type %q", rule.Name, rule.Type)
+		}
+		if rule.Name == "" {
+			rule.Name = rule.Type
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("alert rule %q is defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Polls < 1 {
+			rule.Polls = 1
+		}
+		if rule.Severity == "" {
+			rule.Severity = "warning"
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,131 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// Webhook posts alerts as JSON to every url. Alerts are queued so a slow
+// endpoint never blocks polling, a failed post is retried with a growing
+// interval and dropped after the last retry.
+type Webhook struct {
+	logger        *zap.Logger
+	client        *http.Client
+	urls          []string
+	retries       int
+	retryInterval time.Duration
+	queue         chan *models.Alert
+
+	shutdownTimeout time.Duration
+}
+
+// NewWebhook creates a notifier, the http client sets the request timeout.
+// Alerts queued on shutdown are given shutdownTimeout to be sent.
+func NewWebhook(logger *zap.Logger, client *http.Client, urls []string, retries int, retryInterval time.Duration, queueLength int, shutdownTimeout time.Duration) *Webhook {
+	return &Webhook{
+		logger:        logger,
+		client:        client,
+		urls:          urls,
+		retries:       retries,
+		retryInterval: retryInterval,
+		queue:         make(chan *models.Alert, queueLength),
+
+		shutdownTimeout: shutdownTimeout,
+	}
+}
+
+// Notify enqueues an alert, when the queue is full the alert is dropped and
+// logged.
+func (w *Webhook) Notify(alert *models.Alert) {
+	select {
+	case w.queue <- alert:
+	default:
+		w.logger.Error("alerts queue is full, dropping alert", zap.String("key", alert.Key), zap.String("status", alert.Status))
+	}
+}
+
+// StartQueue starts a single sender, so alerts of a key are delivered in
+// the order they were raised. When ctx is cancelled alerts already queued
+// are still sent within the shutdown timeout, the rest stay pending.
+func (w *Webhook) StartQueue(ctx context.Context, errGroup *errgroup.Group) {
+	errGroup.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				w.logger.Info("alerts webhook sender is shutting down", zap.Int("queued", len(w.queue)))
+				dctx, cancel := context.WithTimeout(context.Background(), w.shutdownTimeout)
+				defer cancel()
+				for len(w.queue) > 0 && dctx.Err() == nil {
+					w.send(dctx, <-w.queue)
+				}
+				return nil
+			case alert := <-w.queue:
+				w.send(ctx, alert)
+			}
+		}
+	})
+}
+
+// Pending returns how many alerts are queued but not sent yet.
+func (w *Webhook) Pending() int {
+	return len(w.queue)
+}
+
+func (w *Webhook) send(ctx context.Context, alert *models.Alert) {
+	for _, url := range w.urls {
+		if err := w.Send(ctx, url, alert); err != nil {
+			w.logger.Error("error send alert", zap.Error(err), zap.String("url", url), zap.String("key", alert.Key))
+		}
+	}
+}
+
+// Send posts the alert retrying on errors and non 2xx responses.
+func (w *Webhook) Send(ctx context.Context, url string, alert *models.Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	interval := w.retryInterval
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, url, body)
+		if err == nil || attempt >= w.retries {
+			return err
+		}
+		w.logger.Warn("retry alert webhook", zap.Error(err), zap.String("url", url), zap.Int("attempt", attempt+1))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
+
+func (w *Webhook) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
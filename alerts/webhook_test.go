@@ -0,0 +1,107 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"go.uber.org/zap"
+)
+
+// server answers with the given statuses in turn, the last one repeats, a
+// 0 status answers 200 after delay. It records every request.
+type server struct {
+	lock     sync.Mutex
+	statuses []int
+	delay    time.Duration
+	times    []time.Time
+	alerts   []models.Alert
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	attempt := len(s.times)
+	s.times = append(s.times, time.Now())
+	var alert models.Alert
+	if err := json.NewDecoder(r.Body).Decode(&alert); err == nil {
+		s.alerts = append(s.alerts, alert)
+	}
+	status := s.statuses[len(s.statuses)-1]
+	if attempt < len(s.statuses) {
+		status = s.statuses[attempt]
+	}
+	delay := s.delay
+	s.lock.Unlock()
+
+	if delay > 0 && status == 0 {
+		time.Sleep(delay)
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+}
+
+func (s *server) requests() []time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]time.Time(nil), s.times...)
+}
+
+func TestWebhookRetriesServerErrors(t *testing.T) {
+	srv := &server{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	hook := NewWebhook(zap.NewNop(), ts.Client(), nil, 3, 20*time.Millisecond, 1, time.Second)
+	if err := hook.Send(context.Background(), ts.URL, &models.Alert{Key: "busy|1|5", Status: StatusOpen}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	times := srv.requests()
+	if len(times) != 3 {
+		t.Fatalf("want 3 requests, got %d", len(times))
+	}
+	// the retry interval doubles
+	first, second := times[1].Sub(times[0]), times[2].Sub(times[1])
+	if first < 20*time.Millisecond || second < 40*time.Millisecond {
+		t.Fatalf("want backoff of 20ms then 40ms, got %s then %s", first, second)
+	}
+	if srv.alerts[2].Key != "busy|1|5" {
+		t.Fatalf("unexpected alert posted %+v", srv.alerts[2])
+	}
+}
+
+func TestWebhookGivesUpAfterRetries(t *testing.T) {
+	srv := &server{statuses: []int{http.StatusServiceUnavailable}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	hook := NewWebhook(zap.NewNop(), ts.Client(), nil, 2, time.Millisecond, 1, time.Second)
+	if err := hook.Send(context.Background(), ts.URL, &models.Alert{}); err == nil {
+		t.Fatal("want an error after the last retry")
+	}
+	if n := len(srv.requests()); n != 3 {
+		t.Fatalf("want 3 requests, got %d", n)
+	}
+}
+
+func TestWebhookRetriesTimeouts(t *testing.T) {
+	// the first request outlives the client timeout
+	srv := &server{statuses: []int{0, http.StatusOK}, delay: 200 * time.Millisecond}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	client := ts.Client()
+	client.Timeout = 50 * time.Millisecond
+	hook := NewWebhook(zap.NewNop(), client, nil, 1, time.Millisecond, 1, time.Second)
+	if err := hook.Send(context.Background(), ts.URL, &models.Alert{}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if n := len(srv.requests()); n != 2 {
+		t.Fatalf("want 2 requests, got %d", n)
+	}
+}
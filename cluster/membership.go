@@ -0,0 +1,175 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// ChangeFunc receives live pollers, including this one, sorted by id.
+type ChangeFunc func(members []string)
+
+// Membership registers the poller in a heartbeat table of the LibreNMS
+// database and finds live peers. A peer which did not beat within deadAfter
+// is dead, its devices are taken over by the others on the next change.
+// Database time is used so poller clocks don't need to be in sync.
+type Membership struct {
+	logger    *zap.Logger
+	db        *sqlx.DB
+	table     string
+	id        string
+	interval  time.Duration
+	deadAfter time.Duration
+	onChange  ChangeFunc
+
+	members []string
+	// start of the last successful beat
+	lastBeat time.Time
+	fenced   bool
+}
+
+func New(logger *zap.Logger, db *sqlx.DB, table, id string, interval, deadAfter time.Duration, onChange ChangeFunc) *Membership {
+	return &Membership{
+		logger:    logger,
+		db:        db,
+		table:     table,
+		id:        id,
+		interval:  interval,
+		deadAfter: deadAfter,
+		onChange:  onChange,
+	}
+}
+
+func (m *Membership) InitDb(ctx context.Context) error {
+	stm := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		poller_id VARCHAR(255) NOT NULL PRIMARY KEY,
+		started_at DATETIME NOT NULL,
+		last_seen DATETIME NOT NULL
+	)`, m.table)
+	_, err := m.db.ExecContext(ctx, stm)
+	return err
+}
+
+// Join beats once and reads peers, so devices are split before the first
+// poll, then keeps beating until the context is done and leaves. When beats
+// fail for so long that peers could consider this poller dead before the
+// next one, it is fenced: members are set to none so it polls nothing until
+// a beat succeeds again.
+func (m *Membership) Join(ctx context.Context, eg *errgroup.Group) error {
+	if err := m.beat(ctx); err != nil {
+		return err
+	}
+
+	eg.Go(func() error {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.beat(ctx); err != nil {
+					m.logger.Error("error poller heartbeat", zap.Error(err))
+					m.fence()
+				}
+			case <-ctx.Done():
+				m.leave()
+				return nil
+			}
+		}
+	})
+	return nil
+}
+
+func (m *Membership) beat(ctx context.Context) error {
+	started := time.Now()
+	stm := fmt.Sprintf(`INSERT INTO %s (poller_id, started_at, last_seen) VALUES (?, NOW(), NOW())
+	ON DUPLICATE KEY UPDATE last_seen = NOW()`, m.table)
+	if _, err := m.db.ExecContext(ctx, stm, m.id); err != nil {
+		return err
+	}
+
+	var members []string
+	query := fmt.Sprintf(`SELECT poller_id FROM %s WHERE last_seen >= NOW() - INTERVAL ? SECOND`, m.table)
+	if err := m.db.SelectContext(ctx, &members, query, int(m.deadAfter.Seconds())); err != nil {
+		return err
+	}
+	if !contains(members, m.id) {
+		members = append(members, m.id)
+	}
+	sort.Strings(members)
+	m.lastBeat = started
+	if m.fenced {
+		m.logger.Info("poller heartbeat is back, resume polling", zap.String("poller_id", m.id))
+		m.fenced = false
+	}
+
+	if equal(members, m.members) {
+		return nil
+	}
+	m.logger.Info("poller members changed", zap.String("poller_id", m.id), zap.Strings("members", members), zap.Strings("joined", missing(members, m.members)), zap.Strings("left", missing(m.members, members)))
+	m.members = members
+	m.onChange(members)
+	return nil
+}
+
+// fence stops polling once peers could take over our devices before the
+// next beat, so no device is polled twice.
+func (m *Membership) fence() {
+	if m.fenced || time.Since(m.lastBeat)+m.interval < m.deadAfter {
+		return
+	}
+	m.logger.Error("poller heartbeat failed for too long, stop polling until it is back", zap.String("poller_id", m.id), zap.Time("last_beat", m.lastBeat), zap.Duration("dead_after", m.deadAfter))
+	m.fenced = true
+	m.members = nil
+	m.onChange(nil)
+}
+
+// leave deletes our heartbeat, so peers take over without waiting for it
+// to expire.
+func (m *Membership) leave() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.interval)
+	defer cancel()
+	stm := fmt.Sprintf(`DELETE FROM %s WHERE poller_id = ?`, m.table)
+	if _, err := m.db.ExecContext(ctx, stm, m.id); err != nil {
+		m.logger.Error("error leave poller members", zap.Error(err))
+		return
+	}
+	m.logger.Info("left poller members", zap.String("poller_id", m.id))
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// missing returns values of a which are not in b.
+func missing(a, b []string) []string {
+	var values []string
+	for _, v := range a {
+		if !contains(b, v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/logingood/yt-snmp-go-poller/config"
+	"github.com/logingood/yt-snmp-go-poller/internal/lgr"
+	"github.com/logingood/yt-snmp-go-poller/storer/availability/avail_chouse"
+	"github.com/sethvargo/go-envconfig"
+	"go.uber.org/zap"
+)
+
+type availabilityConfig struct {
+	ClickhouseAvailabilityTableName string `env:"CLICKHOUSE_AVAILABILITY_TABLE_NAME,default=device_availability"`
+	config.Clickhouse
+}
+
+// availability prints availability of a device over a window from the
+// availability table the poller writes.
+func main() {
+	var (
+		deviceID = flag.Int("device", 0, "LibreNMS device id")
+		window   = flag.Duration("window", 24*time.Hour, "window ending now")
+		format   = flag.String("format", "table", "output format: json or table")
+	)
+	flag.Parse()
+	if *deviceID == 0 {
+		fmt.Fprintln(os.Stderr, "-device is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	logger := lgr.InitializeStderrLogger()
+	ctx := context.Background()
+
+	var cfg availabilityConfig
+	if err := envconfig.Process(ctx, &cfg); err != nil {
+		logger.Fatal("cannot read config", zap.Error(err))
+	}
+	if err := cfg.Clickhouse.Validate(); err != nil {
+		logger.Fatal("cannot read config", zap.Error(err))
+	}
+	conn, err := clickhouse.Open(cfg.Options())
+	if err != nil {
+		logger.Fatal("error open clickhouse conn", zap.Error(err))
+	}
+	defer conn.Close()
+
+	client := avail_chouse.New(logger, conn, &config.FromEnv{
+		ClickhouseAvailabilityTableName: cfg.ClickhouseAvailabilityTableName,
+		Clickhouse:                      cfg.Clickhouse,
+	})
+	summary, err := client.Availability(ctx, int32(*deviceID), *window)
+	if err != nil {
+		logger.Fatal("error query availability", zap.Error(err), zap.Int("device_id", *deviceID))
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(summary); err != nil {
+			logger.Fatal("error encode summary", zap.Error(err))
+		}
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DEVICE\tWINDOW\tPOLLS\tREACHABLE\tAVAILABILITY\tAVG RESPONSE")
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%.3f%%\t%.1fms\n", summary.DeviceID, *window, summary.Polls, summary.ReachablePolls, summary.AvailabilityPct, summary.AvgResponseTimeMs)
+		w.Flush()
+	}
+}
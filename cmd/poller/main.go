@@ -2,27 +2,41 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"net/http"
 	"os"
-	"os/signal"
 	"strconv"
 	"time"
 
-	"github.com/ClickHouse/clickhouse-go/v2"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	"github.com/logingood/yt-snmp-go-poller/alerts"
+	"github.com/logingood/yt-snmp-go-poller/cluster"
 	"github.com/logingood/yt-snmp-go-poller/config"
+	"github.com/logingood/yt-snmp-go-poller/devices/cache"
 	"github.com/logingood/yt-snmp-go-poller/devices/sql"
+	"github.com/logingood/yt-snmp-go-poller/events"
 	"github.com/logingood/yt-snmp-go-poller/internal/lgr"
 	"github.com/logingood/yt-snmp-go-poller/models"
-	"github.com/logingood/yt-snmp-go-poller/storer/interfaces/iface_chouse"
+	"github.com/logingood/yt-snmp-go-poller/rates"
+	"github.com/logingood/yt-snmp-go-poller/snmp"
 	"github.com/logingood/yt-snmp-go-poller/worker"
 	"github.com/sethvargo/go-envconfig"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
 
+const (
+	exitOk    = 0
+	exitError = 1
+	// polls or stored data were lost on shutdown
+	exitDataLost = 2
+)
+
 func main() {
+	os.Exit(run())
+}
+
+func run() int {
 	logger := lgr.InitializeLogger()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -30,66 +44,259 @@ func main() {
 	var cfg config.FromEnv
 	if err := envconfig.Process(ctx, &cfg); err != nil {
 		logger.Fatal("cannot read config", zap.Error(err))
-		os.Exit(1)
+		return exitError
+	}
+	if err := cfg.Validate(); err != nil {
+		logger.Error("bad config", zap.Error(err))
+		return exitError
+	}
+	if cfg.Storer == storerStdout {
+		// stdout is for polls only
+		logger = lgr.InitializeStderrLogger()
 	}
 
-	// handle ctrl + c
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	defer func() {
-		signal.Stop(c)
-		cancel()
-	}()
-
-	go func() {
-		select {
-		case <-c:
-			cancel()
-		case <-ctx.Done():
-		}
-	}()
+	// handle ctrl + c and SIGTERM
+	go signalHandler(ctx, cancel, logger)
 
-	db, err := sqlx.Connect("mysql", getConnStringFromCfg(&cfg))
+	db, err := sqlx.Connect("mysql", cfg.ConnString())
 	if err != nil {
 		logger.Error("error create mysql conn", zap.Error(err))
-		os.Exit(1)
+		return exitError
 	}
 	defer db.Close()
 
 	if err := db.Ping(); err != nil {
 		logger.Error("db did not ping", zap.Error(err))
-		os.Exit(1)
+		return exitError
 	}
 
-	dbClient := sql.New(db, logger)
+	dbClient := sql.New(db, logger, cfg.PollerGroups, cfg.DevicesPageSize)
 
-	ifaceConn, err := clickhouse.Open(getClickHouseConn(&cfg))
+	// storers outlive ctx, they are stopped once polls in flight are done
+	flushCtx, flush := context.WithCancel(context.Background())
+	defer flush()
+	storerGroup, sctx := errgroup.WithContext(flushCtx)
+	storer, err := newSink(sctx, logger, &cfg, storerGroup)
+	if err != nil {
+		logger.Error("error create storer", zap.Error(err), zap.String("storer", cfg.Storer))
+		return exitError
+	}
+
+	ospfTracker := events.NewOspfTracker()
+	ifaceTracker := events.NewInterfaceTracker()
+	availTracker := events.NewAvailabilityTracker()
+	rateCalc := rates.New(logger)
 
-	storerGroup, sctx := errgroup.WithContext(ctx)
-	storer := iface_chouse.New(logger, ifaceConn, &cfg)
-	if err := storer.InitDb(sctx); err != nil {
-		logger.Error("error init db", zap.Error(err))
-		os.Exit(1)
+	var (
+		alertEngine *alerts.Engine
+		webhook     *alerts.Webhook
+	)
+	if cfg.AlertRulesFile != "" {
+		rules, err := alerts.LoadRules(cfg.AlertRulesFile)
+		if err != nil {
+			logger.Error("error load alert rules", zap.Error(err))
+			return exitError
+		}
+		webhook = alerts.NewWebhook(logger, &http.Client{Timeout: cfg.AlertWebhookTimeout}, cfg.AlertWebhookURLs, cfg.AlertWebhookRetries, cfg.AlertWebhookRetryDelay, cfg.AlertQueueLength, cfg.ShutdownTimeout)
+		webhook.StartQueue(sctx, storerGroup)
+		alertEngine = alerts.NewEngine(logger, rules, webhook)
+		logger.Info("loaded alert rules", zap.Int("rules", len(rules)), zap.Int("webhooks", len(cfg.AlertWebhookURLs)))
 	}
-	storer.StartQueue(sctx, storerGroup)
 
-	offset, max := getWorkerRangeAndOfset(logger)
+	var sharder *worker.Sharder
+	if cfg.ClusterMembership {
+		if cfg.ClusterPollerID == "" {
+			cfg.ClusterPollerID, _ = os.Hostname()
+		}
+		sharder = worker.NewMemberSharder(logger, cfg.ClusterPollerID)
+	} else {
+		sharder, err = worker.NewSharder(logger, cfg.ShardCount, cfg.ShardIndex)
+		if err != nil {
+			logger.Error("error create sharder", zap.Error(err))
+			return exitError
+		}
+	}
+
+	snmpSettings := &snmp.Settings{
+		ContextName:  cfg.SnmpV3ContextName,
+		ContextNames: cfg.SnmpV3DeviceContexts,
+		EngineIDs:    cfg.SnmpV3EngineIDs,
+		Engines:      snmp.NewEngineCache(),
+
+		EnforceEngineIDs:  cfg.SnmpV3EnforceEngineIDs,
+		CollectorContexts: cfg.SnmpV3CollectorContexts,
+
+		Timeout:                cfg.SnmpTimeout,
+		MinTimeout:             cfg.SnmpMinTimeout,
+		MaxTimeout:             cfg.SnmpMaxTimeout,
+		Timeouts:               cfg.SnmpDeviceTimeouts,
+		Retries:                cfg.SnmpRetries,
+		MaxConsecutiveTimeouts: cfg.SnmpMaxConsecutiveTimeouts,
+		Rtt:                    snmp.NewRttTracker(),
+	}
+	if cfg.SnmpRateLimit > 0 || cfg.SnmpDeviceRateLimit > 0 || len(cfg.SnmpDeviceRateLimits) > 0 || len(cfg.SnmpOSRateLimits) > 0 {
+		snmpSettings.Limiter = snmp.NewRateLimiter(cfg.SnmpRateLimit, cfg.SnmpDeviceRateLimit, cfg.SnmpDeviceRateLimits, cfg.SnmpOSRateLimits)
+	}
+
+	sessions := snmp.NewPool(logger, snmpSettings)
+	defer sessions.Close()
+
+	// modules which did not run in a poll are not stored
+	store := func(snmpMap *models.SnmpInterfaceMetrics) error {
+		if ospfEvents := ospfTracker.Diff(snmpMap); len(ospfEvents) > 0 {
+			if err := storer.InsertOspfEvents(sctx, ospfEvents); err != nil {
+				logger.Error("error insert ospf events", zap.Error(err))
+			}
+		}
+		if snmpMap.Collected(snmp.CollectorCounters) {
+			if ifaceEvents := ifaceTracker.Diff(snmpMap); len(ifaceEvents) > 0 {
+				if err := storer.InsertInterfaceEvents(sctx, ifaceEvents); err != nil {
+					logger.Error("error insert interface events", zap.Error(err))
+				}
+			}
+		}
+		return storer.InsertMetrics(sctx, []*models.SnmpInterfaceMetrics{snmpMap})
+	}
+	decorators := []snmp.Decorator{rateCalc.SetRates}
+	if alertEngine != nil {
+		// alerts need rates, the last decorator runs first
+		decorators = []snmp.Decorator{alertEngine.Evaluate, rateCalc.SetRates}
+	}
 
 	workerGroup, wctx := errgroup.WithContext(ctx)
-	q := worker.New(logger, dbClient, getInterval(logger), func(snmpMap *models.SnmpInterfaceMetrics) error {
-		return storer.Insert([]*models.SnmpInterfaceMetrics{snmpMap})
-	}, workerGroup, getWorkersNum(logger), getWorkersNum(logger), offset, max)
+	scheduler, err := worker.NewScheduler(getInterval(logger), cfg.PollingDeviceIntervals, cfg.PollingOverrunPolicy, cfg.PollDownFactor)
+	if err != nil {
+		logger.Error("error create scheduler", zap.Error(err))
+		return exitError
+	}
+	priorities, err := worker.NewPriorities(worker.PriorityRules{
+		Classes:  cfg.PollPriorityClasses,
+		MinShare: cfg.PollPriorityMinShare,
+		Shares:   cfg.PollPriorityShares,
+		Devices:  cfg.PollPriorityDevices,
+		Groups:   cfg.PollPriorityGroups,
+		OS:       cfg.PollPriorityOS,
+		Attrib:   cfg.PollPriorityAttrib,
+	}, dbClient)
+	if err != nil {
+		logger.Error("error create priority classes", zap.Error(err))
+		return exitError
+	}
+	modules, err := worker.NewModuleSchedule(cfg.PollingModuleIntervals)
+	if err != nil {
+		logger.Error("error create module schedule", zap.Error(err))
+		return exitError
+	}
+	backoff := worker.NewBackoff(cfg.PollBackoffAfter, cfg.PollBackoffBase, cfg.PollBackoffMax)
+	var q *worker.Queue
+	inventory := cache.New(logger, dbClient, cfg.DevicesRefreshInterval, func(changes cache.Changes) {
+		for _, id := range changes.Credentials {
+			sessions.Invalidate(id)
+		}
+		q.Rebalance()
+	})
+	q = worker.New(logger, inventory, dbClient, scheduler, backoff, snmp.Compose(store, decorators...), sessions, func(sample *models.DeviceAvailability) {
+		if err := storer.InsertAvailability(sctx, []*models.DeviceAvailability{sample}); err != nil {
+			logger.Error("error insert availability", zap.Error(err))
+		}
+		if alertEngine != nil {
+			alertEngine.EvaluateAvailability(sample)
+		}
+		if event := availTracker.Record(sample); event != nil {
+			logger.Info("device state changed", zap.Int32("device_id", event.DeviceID), zap.String("event", event.Event), zap.String("error_class", event.ErrorClass))
+			if err := storer.InsertDeviceEvents(sctx, []*models.DeviceEvent{event}); err != nil {
+				logger.Error("error insert device event", zap.Error(err))
+			}
+		}
+	}, func(result *models.PollResult) {
+		if err := storer.InsertPollResults(sctx, []*models.PollResult{result}); err != nil {
+			logger.Error("error insert poll result", zap.Error(err))
+		}
+	}, worker.DevicePolicy{
+		SkipDisabled:      cfg.PollSkipDisabled,
+		SkipIgnored:       cfg.PollSkipIgnored,
+		SkipDisabledPorts: cfg.PollSkipDisabledPorts,
+		SkipIgnoredPorts:  cfg.PollSkipIgnoredPorts,
+	}, sharder, priorities, modules, workerGroup, getWorkersNum(logger), getWorkersNum(logger))
 	q.StartWorkerPool(wctx)
 
 	group, qctx := errgroup.WithContext(ctx)
+	if cfg.ClusterMembership {
+		membership := cluster.New(logger, db, cfg.ClusterHeartbeatTable, cfg.ClusterPollerID, cfg.ClusterHeartbeatInterval, cfg.ClusterDeadAfter, func(members []string) {
+			sharder.SetMembers(members)
+			q.Rebalance()
+		})
+		if err := membership.InitDb(ctx); err != nil {
+			logger.Error("error init heartbeat table", zap.Error(err))
+			return exitError
+		}
+		if err := membership.Join(qctx, group); err != nil {
+			logger.Error("error join poller members", zap.Error(err))
+			return exitError
+		}
+	}
+	if err := inventory.Start(qctx, group); err != nil {
+		logger.Error("error load devices", zap.Error(err))
+		return exitError
+	}
 	group.Go(func() error {
 		return q.StartDispatcher(qctx)
 	})
 
+	code := exitOk
 	if err := group.Wait(); err != nil {
 		logger.Error("error occurred", zap.Error(err))
-	} else {
-		logger.Error("have a jolly day")
+		code = exitError
+	}
+	// workers drop queued polls once ctx is done
+	cancel()
+
+	deadline := time.Now().Add(cfg.ShutdownTimeout)
+	logger.Info("waiting for polls in flight", zap.Int("in_flight", scheduler.Stats().InFlight), zap.Duration("timeout", cfg.ShutdownTimeout))
+	aborted := 0
+	if !waitUntil(workerGroup, deadline) {
+		aborted = scheduler.Stats().InFlight
+	}
+
+	logger.Info("flushing storers", zap.Int("queued", storer.Pending()))
+	storer.Close()
+	flush()
+	unflushed := 0
+	if !waitUntil(storerGroup, deadline) {
+		unflushed = storer.Pending()
+		if webhook != nil {
+			unflushed += webhook.Pending()
+		}
+	}
+
+	dropped := q.Dropped()
+	failed := storer.Lost()
+	if dropped > 0 || aborted > 0 || unflushed > 0 || failed > 0 {
+		logger.Error("stopped, data was lost", zap.Int64("dropped_polls", dropped), zap.Int("aborted_polls", aborted), zap.Int("unflushed", unflushed), zap.Int64("failed_inserts", failed))
+		if code == exitOk {
+			code = exitDataLost
+		}
+		return code
+	}
+	logger.Info("stopped cleanly, have a jolly day")
+	return code
+}
+
+// waitUntil waits for the group until the deadline, it reports if the group
+// finished in time.
+func waitUntil(group *errgroup.Group, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
 	}
 }
 
@@ -127,49 +334,3 @@ func getInterval(logger *zap.Logger) time.Duration {
 
 	return interval
 }
-
-func getWorkerRangeAndOfset(logger *zap.Logger) (int, int) {
-	offset := 0
-	max := 1000
-
-	workerOffset := os.Getenv("WORKER_OFFSET")
-	if workerOffset != "" {
-		var err error
-		offset, err = strconv.Atoi(workerOffset)
-		if err != nil {
-			logger.Fatal("number of workers must be a number", zap.Any("WORKERS_OFFSET", workerOffset), zap.Error(err))
-			panic(err)
-		}
-	}
-	workerRange := os.Getenv("WORKER_RANGE")
-	if workerRange != "" {
-		var err error
-		max, err = strconv.Atoi(workerRange)
-		if err != nil {
-			logger.Fatal("number of workers must be a number", zap.Any("WORKERS_RANGE", workerRange), zap.Error(err))
-			panic(err)
-		}
-	}
-
-	return offset, max
-}
-
-func getConnStringFromCfg(cfg *config.FromEnv) string {
-	connString := fmt.Sprintf("%s:%s@(%s:%s)/%s", cfg.DbUsername, cfg.DbPassword, cfg.DbHost, cfg.DbPort, cfg.DbName)
-
-	return connString
-}
-
-func getClickHouseConn(cfg *config.FromEnv) *clickhouse.Options {
-	return &clickhouse.Options{
-		Addr: []string{fmt.Sprintf("%s:%s", cfg.ClickhouseAddr, cfg.ClickhousePort)},
-		Auth: clickhouse.Auth{
-			Database: cfg.ClickhouseDb,
-			Username: cfg.ClickhouseUsername,
-			Password: cfg.ClickhousePassword,
-		},
-		Compression: &clickhouse.Compression{
-			Method: clickhouse.CompressionLZ4,
-		},
-	}
-}
@@ -2,7 +2,29 @@ package main
 
 import (
 	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
 )
 
-func signalHandler(ctx context.Context, cancel context.CancelFunc) {
+// signalHandler cancels ctx on the first SIGINT or SIGTERM so the poller
+// shuts down gracefully, a second signal exits right away.
+func signalHandler(ctx context.Context, cancel context.CancelFunc, logger *zap.Logger) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(c)
+
+	select {
+	case sig := <-c:
+		logger.Info("received signal, shutting down", zap.String("signal", sig.String()))
+		cancel()
+	case <-ctx.Done():
+		return
+	}
+
+	sig := <-c
+	logger.Warn("received second signal, exiting now", zap.String("signal", sig.String()))
+	os.Exit(exitError)
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/logingood/yt-snmp-go-poller/config"
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/snmp"
+	"github.com/logingood/yt-snmp-go-poller/storer"
+	"github.com/logingood/yt-snmp-go-poller/storer/availability/avail_chouse"
+	"github.com/logingood/yt-snmp-go-poller/storer/cpu/cpu_chouse"
+	"github.com/logingood/yt-snmp-go-poller/storer/interfaces/iface_chouse"
+	"github.com/logingood/yt-snmp-go-poller/storer/jsonl"
+	"github.com/logingood/yt-snmp-go-poller/storer/ospf/ospf_chouse"
+	"github.com/logingood/yt-snmp-go-poller/storer/polls/poll_chouse"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	storerClickhouse = "clickhouse"
+	storerStdout     = "stdout"
+	storerFile       = "file"
+)
+
+// newSink creates the storer selected by config, ClickHouse tables are
+// created and its queue is started in the group.
+func newSink(ctx context.Context, logger *zap.Logger, cfg *config.FromEnv, group *errgroup.Group) (storer.Sink, error) {
+	switch cfg.Storer {
+	case storerClickhouse:
+		return newClickhouseSink(ctx, logger, cfg, group)
+	case storerStdout:
+		return jsonl.NewStdout(logger), nil
+	case storerFile:
+		return jsonl.NewFile(logger, cfg.StorerFilePath, int64(cfg.StorerFileMaxSizeMB)<<20, cfg.StorerFileMaxAge, cfg.StorerFileMaxBackups)
+	default:
+		return nil, fmt.Errorf("unknown storer %q, use %s, %s or %s", cfg.Storer, storerClickhouse, storerStdout, storerFile)
+	}
+}
+
+// chouseSink stores every kind of data in its own ClickHouse table, the
+// cpu table is optional.
+type chouseSink struct {
+	logger *zap.Logger
+	iface  *iface_chouse.ClickhouseClient
+	cpu    *cpu_chouse.ClickhouseClient
+	ospf   *ospf_chouse.ClickhouseClient
+	avail  *avail_chouse.ClickhouseClient
+	polls  *poll_chouse.ClickhouseClient
+}
+
+func newClickhouseSink(ctx context.Context, logger *zap.Logger, cfg *config.FromEnv, group *errgroup.Group) (*chouseSink, error) {
+	if err := cfg.Clickhouse.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.ClickhouseInterfacesTableName == "" {
+		return nil, fmt.Errorf("missing required clickhouse config: CLICKHOUSE_INTERFACES_TABLE_NAME")
+	}
+	conn, err := clickhouse.Open(cfg.Options())
+	if err != nil {
+		return nil, fmt.Errorf("error open clickhouse conn: %w", err)
+	}
+
+	s := &chouseSink{
+		logger: logger,
+		iface:  iface_chouse.New(logger, conn, cfg),
+		ospf:   ospf_chouse.New(logger, conn, cfg),
+		avail:  avail_chouse.New(logger, conn, cfg),
+		polls:  poll_chouse.New(logger, conn, cfg),
+	}
+	if err := s.iface.InitDb(ctx); err != nil {
+		return nil, fmt.Errorf("error init db: %w", err)
+	}
+	if cfg.ClickhouseCpuTableName != "" {
+		s.cpu = cpu_chouse.New(logger, conn, cfg)
+		if err := s.cpu.InitDb(ctx); err != nil {
+			return nil, fmt.Errorf("error init cpu db: %w", err)
+		}
+	}
+	if err := s.ospf.InitDb(ctx); err != nil {
+		return nil, fmt.Errorf("error init ospf db: %w", err)
+	}
+	if err := s.avail.InitDb(ctx); err != nil {
+		return nil, fmt.Errorf("error init availability db: %w", err)
+	}
+	if err := s.polls.InitDb(ctx); err != nil {
+		return nil, fmt.Errorf("error init poll log db: %w", err)
+	}
+	if err := s.iface.StartQueue(ctx, group); err != nil {
+		return nil, err
+	}
+	s.avail.StartQueue(ctx, group)
+	return s, nil
+}
+
+// InsertMetrics logs cpu and ospf errors, interfaces are queued and
+// inserted in the background, so shutdown drains them.
+func (s *chouseSink) InsertMetrics(ctx context.Context, metrics []*models.SnmpInterfaceMetrics) error {
+	for _, snmpMap := range metrics {
+		batch := []*models.SnmpInterfaceMetrics{snmpMap}
+		if s.cpu != nil && snmpMap.Collected(snmp.CollectorCpu) {
+			if err := s.cpu.Insert(batch); err != nil {
+				s.logger.Error("error insert cpu", zap.Error(err))
+			}
+		}
+		if snmpMap.Collected(snmp.CollectorOspf) {
+			if err := s.ospf.Insert(batch); err != nil {
+				s.logger.Error("error insert ospf neighbours", zap.Error(err))
+			}
+		}
+		if !snmpMap.Collected(snmp.CollectorCounters) {
+			continue
+		}
+		if err := s.iface.Write(snmpMap); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *chouseSink) InsertInterfaceEvents(ctx context.Context, events []*models.InterfaceEvent) error {
+	return s.iface.InsertEvents(events)
+}
+
+func (s *chouseSink) InsertOspfEvents(ctx context.Context, events []*models.OspfNeighbourEvent) error {
+	return s.ospf.InsertEvents(events)
+}
+
+// InsertAvailability queues samples, they are inserted in batches.
+func (s *chouseSink) InsertAvailability(ctx context.Context, samples []*models.DeviceAvailability) error {
+	for _, sample := range samples {
+		s.avail.Write(sample)
+	}
+	return nil
+}
+
+func (s *chouseSink) InsertDeviceEvents(ctx context.Context, events []*models.DeviceEvent) error {
+	return s.avail.InsertEvents(ctx, events)
+}
+
+func (s *chouseSink) InsertPollResults(ctx context.Context, results []*models.PollResult) error {
+	return s.polls.Insert(ctx, results)
+}
+
+func (s *chouseSink) Close() error {
+	s.iface.Close()
+	return nil
+}
+
+func (s *chouseSink) Pending() int {
+	return s.iface.Pending() + s.avail.Pending()
+}
+
+func (s *chouseSink) Lost() int64 {
+	return s.iface.Lost() + s.avail.Lost()
+}
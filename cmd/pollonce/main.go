@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	dbsql "database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/logingood/yt-snmp-go-poller/config"
+	"github.com/logingood/yt-snmp-go-poller/devices/sql"
+	"github.com/logingood/yt-snmp-go-poller/internal/lgr"
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/snmp"
+	"github.com/sethvargo/go-envconfig"
+	"go.uber.org/zap"
+)
+
+// output is what a poll printed as JSON.
+type output struct {
+	Device  *models.SnmpInterfaceMetrics `json:"device"`
+	Walks   []snmp.WalkTiming            `json:"walks"`
+	Elapsed time.Duration                `json:"elapsed"`
+	Error   string                       `json:"error,omitempty"`
+}
+
+// pollonce polls a single device once with the poller collectors and prints
+// the result, the device is looked up in LibreNMS by id or given by flags.
+func main() {
+	var (
+		deviceID    = flag.Int("device", 0, "LibreNMS device id, looked up with DB_* env")
+		hostname    = flag.String("host", "", "hostname or address when not using -device")
+		port        = flag.Int("port", 161, "snmp port")
+		version     = flag.String("version", "v2c", "snmp version: 1, v2c or v3")
+		community   = flag.String("community", "public", "v1/v2c community")
+		authLevel   = flag.String("authlevel", "authPriv", "v3 auth level: noAuthNoPriv, authNoPriv or authPriv")
+		authName    = flag.String("authname", "", "v3 user")
+		authPass    = flag.String("authpass", "", "v3 auth passphrase")
+		authAlgo    = flag.String("authalgo", "SHA", "v3 auth algo: MD5, SHA, SHA-224, SHA-256, SHA-384 or SHA-512")
+		cryptoPass  = flag.String("cryptopass", "", "v3 privacy passphrase")
+		cryptoAlgo  = flag.String("cryptoalgo", "AES", "v3 privacy algo: DES, AES, AES-192, AES-256, AES-192-C or AES-256-C")
+		osName      = flag.String("os", "", "LibreNMS os, picks vendor collectors")
+		contextName = flag.String("context", "", "v3 context name")
+		timeout     = flag.Duration("timeout", 5*time.Second, "request timeout")
+		retries     = flag.Int("retries", 3, "request retries")
+		format      = flag.String("format", "json", "output format: json or table")
+	)
+	flag.Parse()
+
+	logger := lgr.InitializeStderrLogger()
+	ctx := context.Background()
+
+	var device *models.Device
+	switch {
+	case *deviceID != 0:
+		var err error
+		device, err = lookupDevice(ctx, logger, int32(*deviceID))
+		if err != nil {
+			logger.Error("error look up device", zap.Error(err), zap.Int("device_id", *deviceID))
+			os.Exit(1)
+		}
+	case *hostname != "":
+		device = &models.Device{
+			Hostname:   hostname,
+			SysName:    hostname,
+			Port:       *port,
+			SnmpVer:    version,
+			Community:  community,
+			AuthLevel:  authLevel,
+			AuthName:   authName,
+			AuthPass:   authPass,
+			AuthAlgo:   authAlgo,
+			CryptoPass: cryptoPass,
+			CryptoAlgo: cryptoAlgo,
+			Status:     true,
+		}
+		if *osName != "" {
+			device.OS = osName
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "either -device or -host is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if device.SysName == nil {
+		device.SysName = device.Hostname
+	}
+
+	settings := &snmp.Settings{
+		ContextName: *contextName,
+		Engines:     snmp.NewEngineCache(),
+		Timeout:     *timeout,
+		Retries:     *retries,
+		TraceWalks:  true,
+	}
+	client, err := snmp.New(device, logger, settings)
+	if err != nil {
+		logger.Error("error create snmp client", zap.Error(err))
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	started := time.Now()
+	// set by the interfaces walk too, but shown when it fails
+	metrics := &models.SnmpInterfaceMetrics{
+		DeviceID: device.DeviceID,
+		Hostname: *device.Hostname,
+		SysName:  *device.SysName,
+	}
+	poller := snmp.Compose(
+		func(*models.SnmpInterfaceMetrics) error { return nil },
+		client.SetOspf,
+		client.SetCpu,
+		client.SetCounters,
+		client.GetInterfacesMap, // always keep at the bottom
+	)
+	pollErr := poller(metrics)
+
+	result := output{
+		Device:  metrics,
+		Walks:   client.TakeWalks(),
+		Elapsed: time.Since(started),
+	}
+	if pollErr != nil {
+		result.Error = pollErr.Error()
+	}
+
+	switch *format {
+	case "table":
+		printTable(os.Stdout, &result)
+	default:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(&result); err != nil {
+			logger.Error("error encode result", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+	if pollErr != nil {
+		os.Exit(1)
+	}
+}
+
+func lookupDevice(ctx context.Context, logger *zap.Logger, deviceID int32) (*models.Device, error) {
+	var cfg config.Database
+	if err := envconfig.Process(ctx, &cfg); err != nil {
+		return nil, err
+	}
+	db, err := sqlx.Connect("mysql", cfg.ConnString())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	device, err := sql.New(db, logger, nil, 0).GetDevice(ctx, deviceID)
+	if errors.Is(err, dbsql.ErrNoRows) {
+		return nil, fmt.Errorf("device %d not found", deviceID)
+	}
+	return device, err
+}
+
+func printTable(out io.Writer, result *output) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	m := result.Device
+	fmt.Fprintf(w, "device\t%d\t%s\t%s\n", m.DeviceID, m.Hostname, m.SysName)
+	fmt.Fprintf(w, "os\t%s\t%s\n", m.OS, m.Hardware)
+	fmt.Fprintf(w, "elapsed\t%s\n", result.Elapsed)
+	if result.Error != "" {
+		fmt.Fprintf(w, "error\t%s\n", result.Error)
+	}
+
+	fmt.Fprintln(w, "\nCOLLECTOR\tSTATUS\tDURATION\tERROR")
+	for _, c := range m.Collectors {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Name, c.Status, c.Duration, c.Error)
+	}
+
+	fmt.Fprintln(w, "\nOID\tPDUS\tDURATION\tERROR")
+	for _, walk := range result.Walks {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", walk.Oid, walk.Pdus, walk.Duration, walk.Error)
+	}
+
+	indexes := make([]int, 0, len(m.CountersMap))
+	for ifIndex := range m.CountersMap {
+		indexes = append(indexes, ifIndex)
+	}
+	sort.Ints(indexes)
+	fmt.Fprintln(w, "\nIFINDEX\tNAME\tALIAS\tADMIN\tOPER\tSPEED\tIN OCTETS\tOUT OCTETS")
+	for _, ifIndex := range indexes {
+		iface := m.CountersMap[ifIndex]
+		fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%t\t%d\t%s\t%s\n", ifIndex, iface.IfName, iface.IfAlias, iface.AdminStatus, iface.OperStatus, iface.Speed,
+			counter(iface, "ifHCInOctets"), counter(iface, "ifHCOutOctets"))
+	}
+
+	if len(m.Processors) > 0 {
+		fmt.Fprintln(w, "\nCPU\tDESCR\tLOAD\tSOURCE")
+		for _, p := range m.Processors {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", p.Index, p.Descr, p.Load, p.Source)
+		}
+	}
+	if len(m.Ospf) > 0 {
+		fmt.Fprintln(w, "\nOSPF NEIGHBOUR\tROUTER ID\tAREA\tSTATE")
+		for _, nbr := range m.Ospf {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", nbr.NeighbourAddress, nbr.NeighbourRouterID, nbr.AreaID, nbr.StateName)
+		}
+	}
+}
+
+func counter(iface models.SnmpInterface, name string) string {
+	value, ok := iface.Counters[name]
+	if !ok || value == nil {
+		return "-"
+	}
+	return value.String()
+}
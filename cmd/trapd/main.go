@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/gosnmp/gosnmp"
+	"github.com/jmoiron/sqlx"
+	"github.com/logingood/yt-snmp-go-poller/config"
+	"github.com/logingood/yt-snmp-go-poller/devices/sql"
+	"github.com/logingood/yt-snmp-go-poller/internal/lgr"
+	"github.com/logingood/yt-snmp-go-poller/snmp"
+	"github.com/logingood/yt-snmp-go-poller/storer/traps/trap_chouse"
+	"github.com/logingood/yt-snmp-go-poller/trap"
+	"github.com/sethvargo/go-envconfig"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+func main() {
+	logger := lgr.InitializeLogger()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var cfg config.TrapFromEnv
+	if err := envconfig.Process(ctx, &cfg); err != nil {
+		logger.Fatal("cannot read config", zap.Error(err))
+	}
+	if err := cfg.Validate(); err != nil {
+		logger.Fatal("cannot read config", zap.Error(err))
+	}
+
+	params, err := getTrapParams(&cfg)
+	if err != nil {
+		logger.Fatal("bad trap config", zap.Error(err))
+	}
+
+	db, err := sqlx.Connect("mysql", cfg.ConnString())
+	if err != nil {
+		logger.Fatal("error create mysql conn", zap.Error(err))
+	}
+	defer db.Close()
+
+	dbClient := sql.New(db, logger, cfg.PollerGroups, cfg.DevicesPageSize)
+
+	trapsConn, err := clickhouse.Open(cfg.Options())
+	if err != nil {
+		logger.Fatal("error open clickhouse conn", zap.Error(err))
+	}
+
+	group, gctx := errgroup.WithContext(ctx)
+	storer := trap_chouse.New(logger, trapsConn, &cfg)
+	if err := storer.InitDb(gctx); err != nil {
+		logger.Fatal("error init db", zap.Error(err))
+	}
+	storer.StartQueue(gctx, group)
+
+	receiver := trap.New(
+		logger,
+		dbClient,
+		params,
+		fmt.Sprintf("udp://%s:%d", cfg.TrapListenAddr, cfg.TrapPort),
+		time.Duration(cfg.TrapDevicesRefreshSeconds)*time.Second,
+		storer.Write,
+	)
+	group.Go(func() error {
+		return receiver.Listen(gctx)
+	})
+
+	if err := group.Wait(); err != nil {
+		logger.Error("error occurred", zap.Error(err))
+		os.Exit(1)
+	}
+	if lost := storer.Lost(); lost > 0 {
+		logger.Error("trap receiver stopped, traps were lost", zap.Int64("lost", lost))
+		os.Exit(2)
+	}
+	logger.Info("trap receiver stopped")
+}
+
+// getTrapParams returns listener params, v1 and v2c are always accepted,
+// v3 is enabled when a username is configured.
+func getTrapParams(cfg *config.TrapFromEnv) (*gosnmp.GoSNMP, error) {
+	params := &gosnmp.GoSNMP{
+		Version:   gosnmp.Version2c,
+		Community: cfg.TrapCommunity,
+	}
+	if cfg.TrapV3Username == "" {
+		return params, nil
+	}
+
+	usm := &gosnmp.UsmSecurityParameters{
+		UserName:                 cfg.TrapV3Username,
+		AuthenticationPassphrase: cfg.TrapV3AuthPass,
+		PrivacyPassphrase:        cfg.TrapV3PrivPass,
+		AuthoritativeEngineID:    cfg.TrapV3EngineID,
+	}
+	// same names as LibreNMS authalgo and cryptoalgo the poller uses
+	var err error
+	if usm.AuthenticationProtocol, err = snmp.AuthProtocol(cfg.TrapV3AuthProto); err != nil {
+		return nil, err
+	}
+	if usm.PrivacyProtocol, err = snmp.PrivProtocol(cfg.TrapV3PrivProto); err != nil {
+		return nil, err
+	}
+
+	params.Version = gosnmp.Version3
+	params.SecurityModel = gosnmp.UserSecurityModel
+	params.SecurityParameters = usm
+	switch cfg.TrapV3AuthLevel {
+	case "noAuthNoPriv":
+		params.MsgFlags = gosnmp.NoAuthNoPriv
+	case "authNoPriv":
+		params.MsgFlags = gosnmp.AuthNoPriv
+	case "authPriv":
+		params.MsgFlags = gosnmp.AuthPriv
+	default:
+		return nil, fmt.Errorf("unsupported security level %q", cfg.TrapV3AuthLevel)
+	}
+
+	return params, nil
+}
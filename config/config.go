@@ -1,29 +1,250 @@
 package config
 
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
 type FromEnv struct {
-	PollingIntervalSeconds int    `env:"POLLING_INTERVAL_SECONDS,required"`
-	WorkersNum             int    `env:"WORKERS_NUM,required"`
-	LogLevel               string `env:"LOG_LEVEL"`
+	PollingIntervalSeconds int `env:"POLLING_INTERVAL_SECONDS,required"`
+	// per device intervals as device_id:duration, e.g. 1:30s,2:5m
+	PollingDeviceIntervals map[int32]time.Duration `env:"POLLING_DEVICE_INTERVALS"`
+	// what to do when a device is due while still polled: skip, delay or catch-up
+	PollingOverrunPolicy string `env:"POLLING_OVERRUN_POLICY,default=skip"`
+	// modules polled less often than devices as module:duration, e.g.
+	// cpu:5m,ospf:5m, other modules run on every poll
+	PollingModuleIntervals map[string]time.Duration `env:"POLLING_MODULE_INTERVALS"`
+	// devices are read from LibreNMS so often, the last good list is used
+	// while the database is unavailable
+	DevicesRefreshInterval time.Duration `env:"DEVICES_REFRESH_INTERVAL,default=1m"`
+	// devices are split between SHARD_COUNT pollers by device id, each
+	// poller polls devices of its SHARD_INDEX
+	ShardCount int `env:"SHARD_COUNT,default=1"`
+	ShardIndex int `env:"SHARD_INDEX,default=0"`
+	// with cluster membership pollers find each other in a heartbeat table
+	// of the LibreNMS database instead, shard count and index are ignored
+	ClusterMembership        bool          `env:"CLUSTER_MEMBERSHIP,default=false"`
+	ClusterPollerID          string        `env:"CLUSTER_POLLER_ID"`
+	ClusterHeartbeatTable    string        `env:"CLUSTER_HEARTBEAT_TABLE,default=poller_heartbeats"`
+	ClusterHeartbeatInterval time.Duration `env:"CLUSTER_HEARTBEAT_INTERVAL,default=10s"`
+	ClusterDeadAfter         time.Duration `env:"CLUSTER_DEAD_AFTER,default=30s"`
+	// LibreNMS flags, devices which are down are polled so many times less
+	// often, 0 or 1 polls them as usual
+	PollSkipDisabled      bool `env:"POLL_SKIP_DISABLED,default=true"`
+	PollSkipIgnored       bool `env:"POLL_SKIP_IGNORED,default=true"`
+	PollDownFactor        int  `env:"POLL_DOWN_FACTOR,default=5"`
+	PollSkipDisabledPorts bool `env:"POLL_SKIP_DISABLED_PORTS,default=true"`
+	PollSkipIgnoredPorts  bool `env:"POLL_SKIP_IGNORED_PORTS,default=false"`
+	// devices failing so many polls in a row are not polled for a while,
+	// starting with base and doubling up to max, 0 disables it
+	PollBackoffAfter int           `env:"POLL_BACKOFF_AFTER,default=3"`
+	PollBackoffBase  time.Duration `env:"POLL_BACKOFF_BASE,default=5m"`
+	PollBackoffMax   time.Duration `env:"POLL_BACKOFF_MAX,default=1h"`
+	WorkersNum       int           `env:"WORKERS_NUM,required"`
+	LogLevel         string        `env:"LOG_LEVEL"`
+	// on SIGTERM polls in flight and storer queues are given so long to
+	// finish, whatever is left after it is lost
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT,default=30s"`
+	// priority classes, highest first, are polled before lower ones while
+	// every lower class gets at least its share of polls. Devices are put in
+	// a class by device_id:class, the class name in the LibreNMS device
+	// attribute POLL_PRIORITY_ATTRIB, LibreNMS device group id:class or
+	// os:class, the lowest class otherwise.
+	PollPriorityClasses  []string           `env:"POLL_PRIORITY_CLASSES"`
+	PollPriorityMinShare float64            `env:"POLL_PRIORITY_MIN_SHARE,default=0.1"`
+	PollPriorityShares   map[string]float64 `env:"POLL_PRIORITY_SHARES"`
+	PollPriorityDevices  map[int32]string   `env:"POLL_PRIORITY_DEVICES"`
+	PollPriorityGroups   map[int32]string   `env:"POLL_PRIORITY_GROUPS"`
+	PollPriorityOS       map[string]string  `env:"POLL_PRIORITY_OS"`
+	PollPriorityAttrib   string             `env:"POLL_PRIORITY_ATTRIB"`
+
+	Database
+
+	// LibreNMS poller groups to poll, all devices if empty
+	PollerGroups []int32 `env:"POLLER_GROUPS"`
+	// devices are read from LibreNMS so many at a time
+	DevicesPageSize int `env:"DEVICES_PAGE_SIZE,default=1000"`
+
+	// SNMPv3 context name for all devices, per device context names and
+	// expected engine ids are maps of device_id:value, engine ids are hex.
+	SnmpV3ContextName    string           `env:"SNMP_V3_CONTEXT_NAME"`
+	SnmpV3DeviceContexts map[int32]string `env:"SNMP_V3_DEVICE_CONTEXTS"`
+	SnmpV3EngineIDs      map[int32]string `env:"SNMP_V3_ENGINE_IDS"`
+	// per collector context names are collector:context, e.g. ospf:vrf1,
+	// they take precedence over the device context
+	SnmpV3CollectorContexts map[string]string `env:"SNMP_V3_COLLECTOR_CONTEXTS"`
+	// polls of a device whose engine id is not the expected one fail
+	// instead of only logging a warning
+	SnmpV3EnforceEngineIDs bool `env:"SNMP_V3_ENFORCE_ENGINE_IDS,default=false"`
+
+	// Request timeouts are derived from response times of a device within
+	// min and max, SNMP_TIMEOUT is used until there are enough samples.
+	// Per device timeouts are device_id:duration and are not adapted.
+	SnmpTimeout                time.Duration           `env:"SNMP_TIMEOUT,default=5s"`
+	SnmpMinTimeout             time.Duration           `env:"SNMP_MIN_TIMEOUT,default=500ms"`
+	SnmpMaxTimeout             time.Duration           `env:"SNMP_MAX_TIMEOUT,default=5s"`
+	SnmpDeviceTimeouts         map[int32]time.Duration `env:"SNMP_DEVICE_TIMEOUTS"`
+	SnmpRetries                int                     `env:"SNMP_RETRIES,default=3"`
+	SnmpMaxConsecutiveTimeouts int                     `env:"SNMP_MAX_CONSECUTIVE_TIMEOUTS,default=2"`
+
+	// Packets per second to all devices and per device, per device limits
+	// are device_id:pps and os:pps, 0 is unlimited.
+	SnmpRateLimit        float64            `env:"SNMP_RATE_LIMIT,default=0"`
+	SnmpDeviceRateLimit  float64            `env:"SNMP_DEVICE_RATE_LIMIT,default=0"`
+	SnmpDeviceRateLimits map[int32]float64  `env:"SNMP_DEVICE_RATE_LIMITS"`
+	SnmpOSRateLimits     map[string]float64 `env:"SNMP_OS_RATE_LIMITS"`
+
+	// Alert rules are a JSON file, alerting is disabled without it. Opened
+	// and resolved alerts are posted to every webhook url.
+	AlertRulesFile         string        `env:"ALERT_RULES_FILE"`
+	AlertWebhookURLs       []string      `env:"ALERT_WEBHOOK_URLS"`
+	AlertWebhookTimeout    time.Duration `env:"ALERT_WEBHOOK_TIMEOUT,default=5s"`
+	AlertWebhookRetries    int           `env:"ALERT_WEBHOOK_RETRIES,default=3"`
+	AlertWebhookRetryDelay time.Duration `env:"ALERT_WEBHOOK_RETRY_DELAY,default=1s"`
+	AlertQueueLength       int           `env:"ALERT_QUEUE_LENGTH,default=1000"`
+
+	/* Each SNMP poller has it's own table */
+	ClickhouseInterfacesTableName      string `env:"CLICKHOUSE_INTERFACES_TABLE_NAME"`
+	ClickhouseCpuTableName             string `env:"CLICKHOUSE_CPU_TABLE_NAME"`
+	ClickhouseStorageTableName         string `env:"CLICKHOUSE_STORAGE_TABLE_NAME"`
+	ClickhouseMemoryTableName          string `env:"CLICKHOUSE_MEMORY_TABLE_NAME"`
+	ClickhouseSfpPowerLevelsTableName  string `env:"CLICKHOUSE_SFP_POWER_LEVELS_TABLE_NAME"`
+	ClickhouseInterfaceEventsTableName string `env:"CLICKHOUSE_INTERFACE_EVENTS_TABLE_NAME,default=interface_events"`
+	ClickhouseAvailabilityTableName    string `env:"CLICKHOUSE_AVAILABILITY_TABLE_NAME,default=device_availability"`
+	ClickhouseOspfNeighboursTableName  string `env:"CLICKHOUSE_OSPF_NEIGHBOURS_TABLE_NAME,default=ospf_neighbours"`
+	ClickhouseOspfEventsTableName      string `env:"CLICKHOUSE_OSPF_EVENTS_TABLE_NAME,default=ospf_neighbour_events"`
+	ClickhousePollLogTableName         string `env:"CLICKHOUSE_POLL_LOG_TABLE_NAME,default=poll_log"`
+	ClickhouseDeviceEventsTableName    string `env:"CLICKHOUSE_DEVICE_EVENTS_TABLE_NAME,default=device_events"`
+
+	ClickhouseQueueLength    int `env:"CLICKHOUSE_QUEUE_LENGTH,default=1000"`
+	ClickhouseFlushFrequency int `env:"CLICKHOUSE_FLUSH_FREQUENCY,default=1000"`
+	Clickhouse
+
+	// where polls are stored: clickhouse, stdout or file. stdout and file
+	// write JSON lines and need no ClickHouse, a file is rotated by size
+	// and age, 0 disables either, and so many rotated files are kept.
+	Storer               string        `env:"STORER,default=clickhouse"`
+	StorerFilePath       string        `env:"STORER_FILE_PATH"`
+	StorerFileMaxSizeMB  int           `env:"STORER_FILE_MAX_SIZE_MB,default=100"`
+	StorerFileMaxAge     time.Duration `env:"STORER_FILE_MAX_AGE,default=1h"`
+	StorerFileMaxBackups int           `env:"STORER_FILE_BACKUPS,default=10"`
+}
+
+// TrapFromEnv is the configuration of the trap receiver daemon, it shares
+// LibreNMS and Clickhouse credentials with the poller.
+type TrapFromEnv struct {
+	LogLevel string `env:"LOG_LEVEL"`
+
+	TrapListenAddr string `env:"TRAP_LISTEN_ADDR,default=0.0.0.0"`
+	TrapPort       int    `env:"TRAP_PORT,default=162"`
+	// how often we re-read devices to match trap sources
+	TrapDevicesRefreshSeconds int `env:"TRAP_DEVICES_REFRESH_SECONDS,default=300"`
+
+	// only traps of devices in these LibreNMS poller groups are matched
+	PollerGroups []int32 `env:"POLLER_GROUPS"`
+	// devices are read from LibreNMS so many at a time
+	DevicesPageSize int `env:"DEVICES_PAGE_SIZE,default=1000"`
 
-	// Librenms DB credentials
+	// v2c community is not enforced by the listener, it is only used to
+	// accept v1/v2c packets. v3 traps and informs require a USM user.
+	TrapCommunity            string `env:"TRAP_COMMUNITY,default=public"`
+	TrapV3Username           string `env:"TRAP_V3_USERNAME"`
+	TrapV3AuthLevel          string `env:"TRAP_V3_AUTH_LEVEL,default=authPriv"`
+	TrapV3AuthProto          string `env:"TRAP_V3_AUTH_PROTO,default=SHA"`
+	TrapV3AuthPass           string `env:"TRAP_V3_AUTH_PASS"`
+	TrapV3PrivProto          string `env:"TRAP_V3_PRIV_PROTO,default=AES"`
+	TrapV3PrivPass           string `env:"TRAP_V3_PRIV_PASS"`
+	TrapV3EngineID           string `env:"TRAP_V3_ENGINE_ID"`
+	ClickhouseTrapsTableName string `env:"CLICKHOUSE_TRAPS_TABLE_NAME,default=traps"`
+	TrapsQueueLength         int    `env:"TRAPS_QUEUE_LENGTH,default=1000"`
+	// on SIGTERM queued traps are given so long to be inserted
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT,default=30s"`
+
+	Database
+	Clickhouse
+}
+
+// Database is LibreNMS MySQL credentials.
+type Database struct {
 	DbUsername string `env:"DB_USERNAME,required"`
 	DbPassword string `env:"DB_PASSWORD,required"`
 	DbHost     string `env:"DB_HOST,required"`
 	DbPort     string `env:"DB_PORT,required"`
 	DbName     string `env:"DB_NAME,required"`
+}
 
-	/* Each SNMP poller has it's own table */
-	ClickhouseInterfacesTableName     string `env:"CLICKHOUSE_INTERFACES_TABLE_NAME,required"`
-	ClickhouseCpuTableName            string `env:"CLICKHOUSE_CPU_TABLE_NAME"`
-	ClickhouseStorageTableName        string `env:"CLICKHOUSE_STORAGE_TABLE_NAME"`
-	ClickhouseMemoryTableName         string `env:"CLICKHOUSE_MEMORY_TABLE_NAME"`
-	ClickhouseSfpPowerLevelsTableName string `env:"CLICKHOUSE_SFP_POWER_LEVELS_TABLE_NAME"`
-
-	ClickhouseQueueLength    int    `env:"CLICKHOUSE_QUEUE_LENGTH,required"`
-	ClickhouseFlushFrequency int    `env:"CLICKHOUSE_FLUSH_FREQUENCY,required"`
-	ClickhouseDb             string `env:"CLICKHOUSE_DB,required"`
-	ClickhouseUsername       string `env:"CLICKHOUSE_USERNAME,required"`
-	ClickhousePassword       string `env:"CLICKHOUSE_PASSWORD,required"`
-	ClickhouseAddr           string `env:"CLICKHOUSE_ADDR,required"`
-	ClickhousePort           string `env:"CLICKHOUSE_PORT,required"`
+// Clickhouse is clickhouse server credentials, they are checked by Validate
+// as the poller may run without ClickHouse.
+type Clickhouse struct {
+	ClickhouseDb       string `env:"CLICKHOUSE_DB"`
+	ClickhouseUsername string `env:"CLICKHOUSE_USERNAME"`
+	ClickhousePassword string `env:"CLICKHOUSE_PASSWORD"`
+	ClickhouseAddr     string `env:"CLICKHOUSE_ADDR"`
+	ClickhousePort     string `env:"CLICKHOUSE_PORT"`
+}
+
+// Validate checks values envconfig can't, e.g. durations which must be
+// positive.
+func (c *FromEnv) Validate() error {
+	if c.DevicesRefreshInterval <= 0 {
+		return fmt.Errorf("DEVICES_REFRESH_INTERVAL must be positive")
+	}
+	if c.ClusterMembership {
+		if c.ClusterHeartbeatInterval <= 0 {
+			return fmt.Errorf("CLUSTER_HEARTBEAT_INTERVAL must be positive")
+		}
+		if c.ClusterDeadAfter <= c.ClusterHeartbeatInterval {
+			return fmt.Errorf("CLUSTER_DEAD_AFTER %s must be greater than CLUSTER_HEARTBEAT_INTERVAL %s", c.ClusterDeadAfter, c.ClusterHeartbeatInterval)
+		}
+	}
+	return nil
+}
+
+// Validate checks ClickHouse credentials and values envconfig can't.
+func (c *TrapFromEnv) Validate() error {
+	if c.TrapDevicesRefreshSeconds <= 0 {
+		return fmt.Errorf("TRAP_DEVICES_REFRESH_SECONDS must be positive")
+	}
+	return c.Clickhouse.Validate()
+}
+
+func (d *Database) ConnString() string {
+	return fmt.Sprintf("%s:%s@(%s:%s)/%s", d.DbUsername, d.DbPassword, d.DbHost, d.DbPort, d.DbName)
+}
+
+// Validate returns an error naming missing credentials, the password may be
+// empty.
+func (c *Clickhouse) Validate() error {
+	var missing []string
+	for _, v := range []struct{ env, value string }{
+		{"CLICKHOUSE_DB", c.ClickhouseDb},
+		{"CLICKHOUSE_USERNAME", c.ClickhouseUsername},
+		{"CLICKHOUSE_ADDR", c.ClickhouseAddr},
+		{"CLICKHOUSE_PORT", c.ClickhousePort},
+	} {
+		if v.value == "" {
+			missing = append(missing, v.env)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required clickhouse config: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (c *Clickhouse) Options() *clickhouse.Options {
+	return &clickhouse.Options{
+		Addr: []string{fmt.Sprintf("%s:%s", c.ClickhouseAddr, c.ClickhousePort)},
+		Auth: clickhouse.Auth{
+			Database: c.ClickhouseDb,
+			Username: c.ClickhouseUsername,
+			Password: c.ClickhousePassword,
+		},
+		Compression: &clickhouse.Compression{
+			Method: clickhouse.CompressionLZ4,
+		},
+	}
 }
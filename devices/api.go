@@ -8,4 +8,22 @@ import (
 
 type Devices interface {
 	ListDevices(ctx context.Context) ([]models.Device, error)
+	// EachDevice calls fn for every device as it is read, so the whole list
+	// is never held in memory, an error from fn stops the listing.
+	EachDevice(ctx context.Context, fn func(models.Device) error) error
+}
+
+// Ports lists ports with LibreNMS flags set.
+type Ports interface {
+	ListFlaggedPorts(ctx context.Context) ([]models.Port, error)
+}
+
+// Groups lists LibreNMS device groups of every device.
+type Groups interface {
+	ListDeviceGroups(ctx context.Context) (map[int32][]int32, error)
+}
+
+// Attribs lists values of a LibreNMS device attribute by device id.
+type Attribs interface {
+	ListDeviceAttribs(ctx context.Context, attribType string) (map[int32]string, error)
 }
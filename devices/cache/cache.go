@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/logingood/yt-snmp-go-poller/devices"
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrNotLoaded is returned until the first successful refresh.
+var ErrNotLoaded = errors.New("devices inventory is not loaded yet")
+
+// Changes are device ids which changed since the previous refresh.
+type Changes struct {
+	Added       []int32
+	Removed     []int32
+	Credentials []int32
+}
+
+func (c Changes) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Credentials) == 0
+}
+
+// ChangeFunc receives changes after a refresh which changed something.
+type ChangeFunc func(Changes)
+
+// Cache is a devices inventory refreshed from a source on its own interval.
+// When the source fails the last good list keeps being served, so a
+// database blip does not stop polling.
+type Cache struct {
+	logger   *zap.Logger
+	source   devices.Devices
+	interval time.Duration
+	onChange ChangeFunc
+
+	lock    sync.RWMutex
+	devices []models.Device
+	// positions in devices by device id
+	index   map[int32]int
+	updated time.Time
+}
+
+// New creates a cache of source, onChange may be nil.
+func New(logger *zap.Logger, source devices.Devices, interval time.Duration, onChange ChangeFunc) *Cache {
+	return &Cache{
+		logger:   logger,
+		source:   source,
+		interval: interval,
+		onChange: onChange,
+	}
+}
+
+// Start loads devices once and fails if it can't, then refreshes them every
+// interval until ctx is cancelled.
+func (c *Cache) Start(ctx context.Context, eg *errgroup.Group) error {
+	if err := c.Refresh(ctx); err != nil {
+		return err
+	}
+	eg.Go(func() error {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				if err := c.Refresh(ctx); err != nil && ctx.Err() == nil {
+					c.logger.Warn("error refresh devices, serving the previous list", zap.Error(err), zap.Duration("age", c.Age()))
+				}
+			}
+		}
+	})
+	return nil
+}
+
+// ListDevices returns the last good list, it is shared and must not be
+// modified, a refresh replaces it with a new one.
+func (c *Cache) ListDevices(ctx context.Context) ([]models.Device, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.updated.IsZero() {
+		return nil, ErrNotLoaded
+	}
+	return c.devices, nil
+}
+
+// EachDevice calls fn for every device of the last good list.
+func (c *Cache) EachDevice(ctx context.Context, fn func(models.Device) error) error {
+	c.lock.RLock()
+	// the list is replaced on refresh, never modified
+	devs, loaded := c.devices, !c.updated.IsZero()
+	c.lock.RUnlock()
+	if !loaded {
+		return ErrNotLoaded
+	}
+	for _, dev := range devs {
+		if err := fn(dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Age returns time since the last successful refresh, 0 before the first.
+func (c *Cache) Age() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.updated.IsZero() {
+		return 0
+	}
+	return time.Since(c.updated)
+}
+
+// Refresh reads devices from the source, on error the cache is unchanged.
+// Changes are found while devices are streamed, against an index of the
+// served list. Readers share the served list without copying, so it is
+// replaced rather than updated in place and both lists are held until the
+// refresh ends, the index only holds positions.
+func (c *Cache) Refresh(ctx context.Context) error {
+	c.lock.RLock()
+	prevDevs, prevIndex, first := c.devices, c.index, c.updated.IsZero()
+	c.lock.RUnlock()
+
+	var changes Changes
+	devs := make([]models.Device, 0, len(prevDevs))
+	index := make(map[int32]int, len(prevDevs))
+	err := c.source.EachDevice(ctx, func(dev models.Device) error {
+		// a custom query may list a device twice, the first one is indexed
+		if _, ok := index[dev.DeviceID]; !ok {
+			index[dev.DeviceID] = len(devs)
+			if i, ok := prevIndex[dev.DeviceID]; !ok {
+				changes.Added = append(changes.Added, dev.DeviceID)
+			} else if !sameCredentials(&prevDevs[i], &dev) {
+				changes.Credentials = append(changes.Credentials, dev.DeviceID)
+			}
+		}
+		devs = append(devs, dev)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for id := range prevIndex {
+		if _, ok := index[id]; !ok {
+			changes.Removed = append(changes.Removed, id)
+		}
+	}
+	for _, ids := range [][]int32{changes.Added, changes.Removed, changes.Credentials} {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+
+	c.lock.Lock()
+	c.devices = devs
+	c.index = index
+	c.updated = time.Now()
+	c.lock.Unlock()
+
+	if first {
+		c.logger.Info("loaded devices inventory", zap.Int("devices", len(devs)))
+		return nil
+	}
+	if changes.Empty() {
+		return nil
+	}
+	c.logger.Info("devices inventory changed", zap.Int("devices", len(devs)), zap.Int32s("added", changes.Added), zap.Int32s("removed", changes.Removed), zap.Int32s("credentials_changed", changes.Credentials))
+	if c.onChange != nil {
+		c.onChange(changes)
+	}
+	return nil
+}
+
+// sameCredentials compares everything needed to reach the snmp agent.
+func sameCredentials(a, b *models.Device) bool {
+	return a.Port == b.Port &&
+		sameString(a.Hostname, b.Hostname) &&
+		sameString(a.Transport, b.Transport) &&
+		sameString(a.SnmpVer, b.SnmpVer) &&
+		sameString(a.Community, b.Community) &&
+		sameString(a.AuthLevel, b.AuthLevel) &&
+		sameString(a.AuthName, b.AuthName) &&
+		sameString(a.AuthPass, b.AuthPass) &&
+		sameString(a.AuthAlgo, b.AuthAlgo) &&
+		sameString(a.CryptoPass, b.CryptoPass) &&
+		sameString(a.CryptoAlgo, b.CryptoAlgo)
+}
+
+func sameString(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -9,50 +9,226 @@ import (
 	"go.uber.org/zap"
 )
 
-const ListQuery = `SELECT
-	device_id,
-	hostname,
-	sysName,
-	community,
-	authlevel,
-	authname, authpass, authalgo, cryptopass, cryptoalgo,
-	snmpver, port, transport,  bgpLocalAs, sysObjectID,
-	sysDescr, sysContact, version, hardware, features, os,
-	status, serial,uptime,
-	(
-		SELECT location FROM locations WHERE id=devices.location_id
-	) AS location,
-	(
-		SELECT lat FROM locations WHERE id=devices.location_id
-	) AS lat,
-	(
-		SELECT lng FROM locations WHERE id=devices.location_id
-	) AS lng
-	FROM devices ORDER BY device_id`
+const listColumns = `SELECT
+	d.device_id, d.poller_group,
+	d.hostname,
+	d.sysName,
+	d.community,
+	d.authlevel,
+	d.authname, d.authpass, d.authalgo, d.cryptopass, d.cryptoalgo,
+	d.snmpver, d.port, d.transport, d.bgpLocalAs, d.sysObjectID,
+	d.sysDescr, d.sysContact, d.version, d.hardware, d.features, d.os,
+	d.status, d.disabled, d.` + "`ignore`" + `, d.serial, d.uptime,
+	l.location, l.lat, l.lng
+	FROM devices d
+	LEFT JOIN locations l ON l.id = d.location_id`
+
+const ListQuery = listColumns + ` ORDER BY d.device_id`
+
+// PageQuery lists up to a limit of devices after a device id, pages are
+// keyed by device id so they are stable while devices are added or deleted.
+const PageQuery = listColumns + ` WHERE d.device_id > ? ORDER BY d.device_id LIMIT ?`
+
+// PageByPollerGroupsQuery is PageQuery of the given LibreNMS poller groups.
+const PageByPollerGroupsQuery = listColumns + ` WHERE d.device_id > ? AND d.poller_group IN (?) ORDER BY d.device_id LIMIT ?`
+
+// DeviceQuery reads a single device by id.
+const DeviceQuery = listColumns + ` WHERE d.device_id = ?`
+
+// FlaggedPortsQuery lists ports LibreNMS was told to not poll or ignore,
+// ports without an ifIndex can't be matched to polled interfaces.
+const FlaggedPortsQuery = `SELECT p.device_id, p.ifIndex, p.disabled, p.` + "`ignore`" + `
+	FROM ports p WHERE (p.disabled = 1 OR p.` + "`ignore`" + ` = 1) AND p.ifIndex IS NOT NULL`
+
+// FlaggedPortsByPollerGroupsQuery is FlaggedPortsQuery of devices of the
+// given LibreNMS poller groups.
+const FlaggedPortsByPollerGroupsQuery = `SELECT p.device_id, p.ifIndex, p.disabled, p.` + "`ignore`" + `
+	FROM ports p JOIN devices d ON d.device_id = p.device_id
+	WHERE (p.disabled = 1 OR p.` + "`ignore`" + ` = 1) AND p.ifIndex IS NOT NULL AND d.poller_group IN (?)`
+
+// DeviceGroupsQuery lists LibreNMS device group membership.
+const DeviceGroupsQuery = `SELECT device_id, device_group_id FROM device_group_device`
+
+// DeviceAttribsQuery lists values of a LibreNMS device attribute.
+const DeviceAttribsQuery = `SELECT device_id, attrib_value FROM devices_attribs WHERE attrib_type = ?`
 
 type Client struct {
-	db     *sqlx.DB
-	logger *zap.Logger
+	db           *sqlx.DB
+	logger       *zap.Logger
+	pollerGroups []int32
+	pageSize     int
 }
 
-func New(db *sqlx.DB, logger *zap.Logger) *Client {
+// New creates a client, with poller groups only devices of those groups are
+// listed. Devices are read pageSize at a time.
+func New(db *sqlx.DB, logger *zap.Logger, pollerGroups []int32, pageSize int) *Client {
+	if pageSize < 1 {
+		pageSize = 1000
+	}
 	return &Client{
-		db:     db,
-		logger: logger,
+		db:           db,
+		logger:       logger,
+		pollerGroups: pollerGroups,
+		pageSize:     pageSize,
 	}
 }
 
+// ListDevices reads the whole list into memory, the poller and the trap
+// receiver use EachDevice.
 func (c *Client) ListDevices(ctx context.Context) ([]models.Device, error) {
 	var devices []models.Device
-	// currently we have 1000 devices, what would happen when there's 10k ?
-	// TODO fixme
-	query := os.Getenv("QUERY")
-	if query == "" {
-		query = ListQuery
+	err := c.EachDevice(ctx, func(dev models.Device) error {
+		devices = append(devices, dev)
+		return nil
+	})
+	return devices, err
+}
+
+// EachDevice reads devices a page at a time, a custom QUERY is streamed row
+// by row as it can't be paginated.
+func (c *Client) EachDevice(ctx context.Context, fn func(models.Device) error) error {
+	var err error
+	if query := os.Getenv("QUERY"); query != "" {
+		err = c.eachRow(ctx, query, fn)
+	} else {
+		err = c.eachPage(ctx, fn)
 	}
-	err := c.db.SelectContext(ctx, &devices, query)
 	if err != nil {
 		c.logger.Error("error list devices", zap.Error(err))
 	}
-	return devices, err
+	return err
+}
+
+func (c *Client) eachPage(ctx context.Context, fn func(models.Device) error) error {
+	var (
+		after int32
+		page  []models.Device
+	)
+	for {
+		query, args, err := c.pageQuery(after)
+		if err != nil {
+			return err
+		}
+		page = page[:0]
+		if err := c.db.SelectContext(ctx, &page, query, args...); err != nil {
+			return err
+		}
+		for _, dev := range page {
+			if err := fn(dev); err != nil {
+				return err
+			}
+		}
+		if len(page) < c.pageSize {
+			return nil
+		}
+		after = page[len(page)-1].DeviceID
+	}
+}
+
+func (c *Client) pageQuery(after int32) (string, []interface{}, error) {
+	if len(c.pollerGroups) == 0 {
+		return PageQuery, []interface{}{after, c.pageSize}, nil
+	}
+	query, args, err := sqlx.In(PageByPollerGroupsQuery, after, c.pollerGroups, c.pageSize)
+	if err != nil {
+		return "", nil, err
+	}
+	return c.db.Rebind(query), args, nil
+}
+
+func (c *Client) eachRow(ctx context.Context, query string, fn func(models.Device) error) error {
+	rows, err := c.db.QueryxContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dev models.Device
+		if err := rows.StructScan(&dev); err != nil {
+			return err
+		}
+		// we can't add a condition to a custom query
+		if !c.inPollerGroups(dev) {
+			continue
+		}
+		if err := fn(dev); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (c *Client) inPollerGroups(dev models.Device) bool {
+	if len(c.pollerGroups) == 0 {
+		return true
+	}
+	for _, group := range c.pollerGroups {
+		if dev.PollerGroup == group {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDevice reads a device by id regardless of poller groups, it returns
+// sql.ErrNoRows when there is no such device.
+func (c *Client) GetDevice(ctx context.Context, deviceID int32) (*models.Device, error) {
+	var dev models.Device
+	if err := c.db.GetContext(ctx, &dev, DeviceQuery, deviceID); err != nil {
+		return nil, err
+	}
+	return &dev, nil
+}
+
+// ListFlaggedPorts lists flagged ports of devices of the poller groups.
+func (c *Client) ListFlaggedPorts(ctx context.Context) ([]models.Port, error) {
+	query, args := FlaggedPortsQuery, []interface{}(nil)
+	if len(c.pollerGroups) > 0 {
+		var err error
+		query, args, err = sqlx.In(FlaggedPortsByPollerGroupsQuery, c.pollerGroups)
+		if err != nil {
+			return nil, err
+		}
+		query = c.db.Rebind(query)
+	}
+	var ports []models.Port
+	err := c.db.SelectContext(ctx, &ports, query, args...)
+	if err != nil {
+		c.logger.Error("error list ports", zap.Error(err))
+	}
+	return ports, err
+}
+
+// ListDeviceGroups returns device group ids by device id.
+func (c *Client) ListDeviceGroups(ctx context.Context) (map[int32][]int32, error) {
+	var rows []struct {
+		DeviceID int32 `db:"device_id"`
+		GroupID  int32 `db:"device_group_id"`
+	}
+	if err := c.db.SelectContext(ctx, &rows, DeviceGroupsQuery); err != nil {
+		c.logger.Error("error list device groups", zap.Error(err))
+		return nil, err
+	}
+	groups := map[int32][]int32{}
+	for _, row := range rows {
+		groups[row.DeviceID] = append(groups[row.DeviceID], row.GroupID)
+	}
+	return groups, nil
+}
+
+// ListDeviceAttribs returns values of an attribute by device id.
+func (c *Client) ListDeviceAttribs(ctx context.Context, attribType string) (map[int32]string, error) {
+	var rows []struct {
+		DeviceID int32  `db:"device_id"`
+		Value    string `db:"attrib_value"`
+	}
+	if err := c.db.SelectContext(ctx, &rows, DeviceAttribsQuery, attribType); err != nil {
+		c.logger.Error("error list device attribs", zap.Error(err), zap.String("attrib_type", attribType))
+		return nil, err
+	}
+	attribs := make(map[int32]string, len(rows))
+	for _, row := range rows {
+		attribs[row.DeviceID] = row.Value
+	}
+	return attribs, nil
 }
@@ -0,0 +1,67 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+)
+
+const (
+	DeviceUp   = "up"
+	DeviceDown = "down"
+)
+
+type deviceState struct {
+	reachable bool
+	since     int64
+}
+
+// AvailabilityTracker remembers whether each device answered the previous
+// poll and turns changes into up/down events.
+type AvailabilityTracker struct {
+	lock   sync.Mutex
+	states map[int32]deviceState
+}
+
+func NewAvailabilityTracker() *AvailabilityTracker {
+	return &AvailabilityTracker{
+		states: map[int32]deviceState{},
+	}
+}
+
+// Record returns an event when the device changed its state. The first
+// sample of a device only produces an event if it is down, otherwise a
+// device which is down since the poller started would never be reported.
+func (a *AvailabilityTracker) Record(sample *models.DeviceAvailability) *models.DeviceEvent {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	prev, ok := a.states[sample.DeviceID]
+	if ok && prev.reachable == sample.Reachable {
+		return nil
+	}
+	a.states[sample.DeviceID] = deviceState{
+		reachable: sample.Reachable,
+		since:     sample.Time,
+	}
+	if !ok && sample.Reachable {
+		return nil
+	}
+
+	event := &models.DeviceEvent{
+		Time:        sample.Time,
+		DeviceID:    sample.DeviceID,
+		PollerGroup: sample.PollerGroup,
+		Hostname:    sample.Hostname,
+		SysName:     sample.SysName,
+		Event:       DeviceUp,
+		ErrorClass:  sample.ErrorClass,
+	}
+	if !sample.Reachable {
+		event.Event = DeviceDown
+	}
+	if ok {
+		event.DurationSeconds = sample.Time - prev.since
+	}
+	return event
+}
@@ -0,0 +1,120 @@
+package events
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+)
+
+const (
+	InterfaceOperStatus  = "oper_status"
+	InterfaceAdminStatus = "admin_status"
+	InterfaceSpeed       = "speed"
+	InterfaceAlias       = "alias"
+	InterfaceMacAddress  = "mac_address"
+)
+
+type interfaceState struct {
+	operStatus  bool
+	adminStatus bool
+	speed       int64
+	alias       string
+	macAddress  string
+}
+
+// InterfaceTracker keeps the last known state of every interface and
+// reports what changed since the previous poll.
+type InterfaceTracker struct {
+	lock       sync.Mutex
+	interfaces map[int32]map[int]interfaceState
+}
+
+func NewInterfaceTracker() *InterfaceTracker {
+	return &InterfaceTracker{
+		interfaces: map[int32]map[int]interfaceState{},
+	}
+}
+
+// Diff returns events since the previous poll of the device, the first
+// poll of a device or an interface only sets the baseline. Interfaces
+// missing from a poll keep their last state.
+func (t *InterfaceTracker) Diff(metrics *models.SnmpInterfaceMetrics) []*models.InterfaceEvent {
+	if len(metrics.CountersMap) == 0 {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	previous, ok := t.interfaces[metrics.DeviceID]
+	if !ok {
+		previous = map[int]interfaceState{}
+		t.interfaces[metrics.DeviceID] = previous
+	}
+
+	now := time.Now().UTC().Unix()
+	var events []*models.InterfaceEvent
+	for ifIndex, iface := range metrics.CountersMap {
+		current := interfaceState{
+			operStatus:  iface.OperStatus,
+			adminStatus: iface.AdminStatus,
+			speed:       interfaceSpeed(iface),
+			alias:       iface.IfAlias,
+			macAddress:  iface.MacAddress,
+		}
+		prev, ok := previous[ifIndex]
+		previous[ifIndex] = current
+		if !ok {
+			continue
+		}
+
+		event := func(name, oldValue, newValue string) {
+			events = append(events, &models.InterfaceEvent{
+				Time:        now,
+				DeviceID:    metrics.DeviceID,
+				PollerGroup: metrics.PollerGroup,
+				Hostname:    metrics.Hostname,
+				SysName:     metrics.SysName,
+				IfIndex:     int32(ifIndex),
+				IfName:      iface.IfName,
+				Event:       name,
+				OldValue:    oldValue,
+				NewValue:    newValue,
+			})
+		}
+		if prev.adminStatus != current.adminStatus {
+			event(InterfaceAdminStatus, upDown(prev.adminStatus), upDown(current.adminStatus))
+		}
+		if prev.operStatus != current.operStatus {
+			event(InterfaceOperStatus, upDown(prev.operStatus), upDown(current.operStatus))
+		}
+		if prev.speed != current.speed {
+			event(InterfaceSpeed, strconv.FormatInt(prev.speed, 10), strconv.FormatInt(current.speed, 10))
+		}
+		if prev.alias != current.alias {
+			event(InterfaceAlias, prev.alias, current.alias)
+		}
+		if prev.macAddress != current.macAddress {
+			event(InterfaceMacAddress, prev.macAddress, current.macAddress)
+		}
+	}
+
+	return events
+}
+
+// interfaceSpeed is bits per second, ifHighSpeed is Mbps and is preferred
+// as ifSpeed saturates at 4.2Gbps.
+func interfaceSpeed(iface models.SnmpInterface) int64 {
+	if high, ok := iface.Counters["ifHighSpeed"]; ok && high != nil && high.Sign() > 0 {
+		return high.Int64() * 1000000
+	}
+	return iface.Speed
+}
+
+func upDown(status bool) string {
+	if status {
+		return "up"
+	}
+	return "down"
+}
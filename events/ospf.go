@@ -0,0 +1,84 @@
+package events
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+)
+
+const OspfNeighbourAbsent = "absent"
+
+// OspfTracker keeps the last known neighbours of every device and reports
+// state changes, including neighbours that appeared or disappeared.
+type OspfTracker struct {
+	lock       sync.Mutex
+	neighbours map[int32]map[string]models.OspfNeighbour
+}
+
+func NewOspfTracker() *OspfTracker {
+	return &OspfTracker{
+		neighbours: map[int32]map[string]models.OspfNeighbour{},
+	}
+}
+
+// Diff returns events since the previous poll of the device, the first
+// poll of a device only sets the baseline. Nil neighbours mean the walk
+// failed, they are ignored.
+func (o *OspfTracker) Diff(metrics *models.SnmpInterfaceMetrics) []*models.OspfNeighbourEvent {
+	if metrics.Ospf == nil {
+		return nil
+	}
+	current := make(map[string]models.OspfNeighbour, len(metrics.Ospf))
+	for _, nbr := range metrics.Ospf {
+		current[ospfNeighbourKey(nbr)] = nbr
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	previous, ok := o.neighbours[metrics.DeviceID]
+	o.neighbours[metrics.DeviceID] = current
+	if !ok {
+		return nil
+	}
+
+	now := time.Now().UTC().Unix()
+	var events []*models.OspfNeighbourEvent
+	for key, nbr := range current {
+		prev, ok := previous[key]
+		switch {
+		case !ok:
+			events = append(events, ospfEvent(now, metrics, nbr, OspfNeighbourAbsent, nbr.StateName))
+		case prev.State != nbr.State:
+			events = append(events, ospfEvent(now, metrics, nbr, prev.StateName, nbr.StateName))
+		}
+	}
+	for key, prev := range previous {
+		if _, ok := current[key]; !ok {
+			events = append(events, ospfEvent(now, metrics, prev, prev.StateName, OspfNeighbourAbsent))
+		}
+	}
+
+	return events
+}
+
+func ospfNeighbourKey(nbr models.OspfNeighbour) string {
+	return fmt.Sprintf("%d|%s|%s|%d", nbr.Version, nbr.NeighbourRouterID, nbr.NeighbourAddress, nbr.IfIndex)
+}
+
+func ospfEvent(now int64, metrics *models.SnmpInterfaceMetrics, nbr models.OspfNeighbour, oldState, newState string) *models.OspfNeighbourEvent {
+	return &models.OspfNeighbourEvent{
+		Time:              now,
+		DeviceID:          metrics.DeviceID,
+		PollerGroup:       metrics.PollerGroup,
+		Hostname:          metrics.Hostname,
+		SysName:           metrics.SysName,
+		Version:           nbr.Version,
+		NeighbourRouterID: nbr.NeighbourRouterID,
+		NeighbourAddress:  nbr.NeighbourAddress,
+		AreaID:            nbr.AreaID,
+		OldState:          oldState,
+		NewState:          newState,
+	}
+}
@@ -25,6 +25,16 @@ func newProductionEncoderConfig() zapcore.EncoderConfig {
 }
 
 func InitializeLogger() *zap.Logger {
+	return initializeLogger("stdout")
+}
+
+// InitializeStderrLogger logs to stderr, for commands which print their
+// output to stdout.
+func InitializeStderrLogger() *zap.Logger {
+	return initializeLogger("stderr")
+}
+
+func initializeLogger(output string) *zap.Logger {
 	var level zapcore.Level
 	logLevel := os.Getenv("LOG_LEVEL")
 	if logLevel == "" {
@@ -37,7 +47,7 @@ func InitializeLogger() *zap.Logger {
 	logger, err := zap.Config{
 		Encoding:      "json",
 		Level:         zap.NewAtomicLevelAt(level),
-		OutputPaths:   []string{"stdout"},
+		OutputPaths:   []string{output},
 		EncoderConfig: newProductionEncoderConfig(),
 	}.Build()
 	if err != nil {
@@ -0,0 +1,22 @@
+package models
+
+// Alert is a rule matched by a device or an interface. It is sent once when
+// opened and once when resolved, IfIndex is 0 for device alerts.
+type Alert struct {
+	Key         string  `json:"key"`
+	Rule        string  `json:"rule"`
+	Type        string  `json:"type"`
+	Severity    string  `json:"severity"`
+	Status      string  `json:"status"` // open or resolved
+	DeviceID    int32   `json:"device_id"`
+	PollerGroup int32   `json:"poller_group"`
+	Hostname    string  `json:"hostname"`
+	SysName     string  `json:"sys_name"`
+	IfIndex     int     `json:"if_index"`
+	IfName      string  `json:"if_name"`
+	Value       float64 `json:"value"`
+	Threshold   float64 `json:"threshold"`
+	Message     string  `json:"message"`
+	OpenedAt    int64   `json:"opened_at"`
+	ResolvedAt  int64   `json:"resolved_at,omitempty"`
+}
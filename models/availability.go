@@ -0,0 +1,36 @@
+package models
+
+// DeviceAvailability is a reachability sample of a device, one per poll.
+type DeviceAvailability struct {
+	Time           int64   `ch:"time" json:"time"`
+	DeviceID       int32   `ch:"device_id" json:"device_id"`
+	PollerGroup    int32   `ch:"poller_group" json:"poller_group"`
+	Hostname       string  `ch:"hostname" json:"hostname"`
+	SysName        string  `ch:"sys_name" json:"sys_name"`
+	Reachable      bool    `ch:"reachable" json:"reachable"`
+	ResponseTimeMs float64 `ch:"response_time_ms" json:"response_time_ms"`
+	ErrorClass     string  `ch:"error_class" json:"error_class"`
+	Error          string  `ch:"error" json:"error"`
+}
+
+// DeviceEvent is an up or down transition of a device. Duration is how long
+// the device was in the previous state, 0 if unknown.
+type DeviceEvent struct {
+	Time            int64  `ch:"time" json:"time"`
+	DeviceID        int32  `ch:"device_id" json:"device_id"`
+	PollerGroup     int32  `ch:"poller_group" json:"poller_group"`
+	Hostname        string `ch:"hostname" json:"hostname"`
+	SysName         string `ch:"sys_name" json:"sys_name"`
+	Event           string `ch:"event" json:"event"` // up or down
+	ErrorClass      string `ch:"error_class" json:"error_class"`
+	DurationSeconds int64  `ch:"duration_seconds" json:"duration_seconds"`
+}
+
+// AvailabilitySummary is availability of a device over a window.
+type AvailabilitySummary struct {
+	DeviceID          int32   `ch:"device_id" json:"device_id"`
+	Polls             uint64  `ch:"polls" json:"polls"`
+	ReachablePolls    uint64  `ch:"reachable_polls" json:"reachable_polls"`
+	AvailabilityPct   float64 `ch:"availability_pct" json:"availability_pct"`
+	AvgResponseTimeMs float64 `ch:"avg_response_time_ms" json:"avg_response_time_ms"`
+}
@@ -23,9 +23,21 @@ type Device struct {
 	Features      *string  `db:"features" json:"features"`
 	OS            *string  `db:"os" json:"os"`
 	Status        bool     `db:"status" json:"status"`
+	PollerGroup   int32    `db:"poller_group" json:"poller_group"`
+	Disabled      bool     `db:"disabled" json:"disabled"`
+	Ignore        bool     `db:"ignore" json:"ignore"`
 	Serial        *string  `db:"serial" json:"serial"`
 	UptimeSeconds *int64   `db:"uptime" json:"uptime"`
 	Location      *string  `db:"location" json:"location"`
 	Lat           *float64 `db:"lat" json:"lat"`
 	Lng           *float64 `db:"lng" json:"lng"`
 }
+
+// Port are LibreNMS flags of an interface, disabled ports are not polled
+// and ignored ports are not alerted on by LibreNMS.
+type Port struct {
+	DeviceID int32 `db:"device_id" json:"device_id"`
+	IfIndex  int   `db:"ifIndex" json:"if_index"`
+	Disabled bool  `db:"disabled" json:"disabled"`
+	Ignore   bool  `db:"ignore" json:"ignore"`
+}
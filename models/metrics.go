@@ -22,23 +22,58 @@ type SnmpInterface struct {
 
 	// Counters will be from .10 to .21
 	Counters map[string]*big.Int `ch:"-" json:"counters"`
+	// Rates are per second rates of counters since the previous poll, nil
+	// when there's no valid previous sample
+	Rates map[string]float64 `ch:"-" json:"rates"`
+}
+
+// SnmpProcessor is a processor load normalised from HOST-RESOURCES-MIB or a
+// vendor MIB. Index is the row index in the source table, vendor tables
+// have composite indexes, e.g. 9.1.0.0 in JUNIPER-MIB.
+type SnmpProcessor struct {
+	Index  string `ch:"index" json:"index"`
+	Descr  string `ch:"descr" json:"descr"`
+	Load   int64  `ch:"load" json:"load"` // percent, 1 minute average
+	Source string `ch:"source" json:"source"`
 }
 
 type SnmpInterfaceMetrics struct {
-	Lock        sync.Mutex
+	Lock        sync.Mutex            `ch:"-" json:"-"`
 	CountersMap map[int]SnmpInterface `ch:"counters_map" json:"counters_map"`
+	Processors  []SnmpProcessor       `ch:"-" json:"processors"`
+	Ospf        []OspfNeighbour       `ch:"-" json:"ospf"`
+	Collectors  []CollectorResult     `ch:"-" json:"collectors"`
+	DeviceID    int32                 `ch:"device_id" json:"device_id"`
+	PollerGroup int32                 `ch:"poller_group" json:"poller_group"`
 	Time        int64                 `ch:"time" json:"time"`
-	SysName     string                `ch:"sys_name" json:"sys_name"`
-	SysDescr    string                `ch:"sys_descr" json:"sys_descr"`
-	Hostname    string                `ch:"hostname" json:"hostname"`
-	Hardware    string                `ch:"hardware" json:"hardware"`
-	OS          string                `ch:"os" json:"os"`
-	Serial      string                `ch:"serial" json:"serial"`
-	ObjectID    string                `ch:"object_id" json:"object_id"`
-	Uptime      int64                 `ch:"uptime" json:"uptime"`
-	Location    string                `ch:"location" json:"location"`
-	Lat         float64               `ch:"lat" json:"lat"`
-	Lng         float64               `ch:"lng" json:"lng"`
+	PolledAt    time.Time             `ch:"-" json:"-"`
+	SysUpTime   uint32                `ch:"-" json:"sys_uptime"` // timeticks
+	// seconds since the previous poll that rates were computed over
+	RateInterval float64 `ch:"rate_interval" json:"rate_interval"`
+	SysName      string  `ch:"sys_name" json:"sys_name"`
+	SysDescr     string  `ch:"sys_descr" json:"sys_descr"`
+	Hostname     string  `ch:"hostname" json:"hostname"`
+	Hardware     string  `ch:"hardware" json:"hardware"`
+	OS           string  `ch:"os" json:"os"`
+	Serial       string  `ch:"serial" json:"serial"`
+	ObjectID     string  `ch:"object_id" json:"object_id"`
+	Uptime       int64   `ch:"uptime" json:"uptime"`
+	Location     string  `ch:"location" json:"location"`
+	Lat          float64 `ch:"lat" json:"lat"`
+	Lng          float64 `ch:"lng" json:"lng"`
+	// time the poll waited for the snmp rate limiter
+	RateLimitWait time.Duration `ch:"-" json:"rate_limit_wait"`
+}
+
+// Collected tells if a collector ran in this poll, collectors can run less
+// often than the device is polled.
+func (s *SnmpInterfaceMetrics) Collected(name string) bool {
+	for _, collector := range s.Collectors {
+		if collector.Name == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *SnmpInterfaceMetrics) SetNeighbour(val string, index int) {
@@ -98,3 +133,18 @@ func (s *SnmpInterfaceMetrics) SetCounters(val *big.Int, index int, coutner stri
 	updateValue.Counters[coutner] = val
 	s.CountersMap[index] = updateValue
 }
+
+// InterfaceEvent is a change of an interface property between two polls,
+// old and new values are formatted as strings, e.g. "up" and "down".
+type InterfaceEvent struct {
+	Time        int64  `ch:"time" json:"time"`
+	DeviceID    int32  `ch:"device_id" json:"device_id"`
+	PollerGroup int32  `ch:"poller_group" json:"poller_group"`
+	Hostname    string `ch:"hostname" json:"hostname"`
+	SysName     string `ch:"sys_name" json:"sys_name"`
+	IfIndex     int32  `ch:"if_index" json:"if_index"`
+	IfName      string `ch:"if_name" json:"if_name"`
+	Event       string `ch:"event" json:"event"`
+	OldValue    string `ch:"old_value" json:"old_value"`
+	NewValue    string `ch:"new_value" json:"new_value"`
+}
@@ -14,7 +14,7 @@ type OSDefinition struct {
 	} `yaml:"over"`
 	Icon               string   `yaml:"icon"`
 	Goodif             []string `yaml:"good_if"`
-	IfName             int      `"yaml:ifname"`
+	IfName             int      `yaml:"ifname"`
 	Processors_Stacked int      `yaml:"processor_stacked"`
 	Discovery          []struct {
 		SysDescr        []string `yaml:"sysDescr"`
@@ -0,0 +1,35 @@
+package models
+
+// OspfNeighbour is an adjacency from OSPF-MIB ospfNbrTable (Version 2) or
+// OSPFV3-MIB ospfv3NbrTable (Version 3).
+type OspfNeighbour struct {
+	Time              int64  `ch:"time" json:"time"`
+	DeviceID          int32  `ch:"device_id" json:"device_id"`
+	PollerGroup       int32  `ch:"poller_group" json:"poller_group"`
+	Hostname          string `ch:"hostname" json:"hostname"`
+	SysName           string `ch:"sys_name" json:"sys_name"`
+	Version           int32  `ch:"version" json:"version"`
+	RouterID          string `ch:"router_id" json:"router_id"`
+	NeighbourRouterID string `ch:"neighbour_router_id" json:"neighbour_router_id"`
+	NeighbourAddress  string `ch:"neighbour_address" json:"neighbour_address"`
+	IfIndex           int32  `ch:"if_index" json:"if_index"`
+	AreaID            string `ch:"area_id" json:"area_id"`
+	State             int32  `ch:"state" json:"state"`
+	StateName         string `ch:"state_name" json:"state_name"`
+}
+
+// OspfNeighbourEvent is a neighbour state change, a neighbour which
+// disappeared from the table has "absent" new state.
+type OspfNeighbourEvent struct {
+	Time              int64  `ch:"time" json:"time"`
+	DeviceID          int32  `ch:"device_id" json:"device_id"`
+	PollerGroup       int32  `ch:"poller_group" json:"poller_group"`
+	Hostname          string `ch:"hostname" json:"hostname"`
+	SysName           string `ch:"sys_name" json:"sys_name"`
+	Version           int32  `ch:"version" json:"version"`
+	NeighbourRouterID string `ch:"neighbour_router_id" json:"neighbour_router_id"`
+	NeighbourAddress  string `ch:"neighbour_address" json:"neighbour_address"`
+	AreaID            string `ch:"area_id" json:"area_id"`
+	OldState          string `ch:"old_state" json:"old_state"`
+	NewState          string `ch:"new_state" json:"new_state"`
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// CollectorResult is the outcome of one collector of a device poll.
+type CollectorResult struct {
+	Name       string        `json:"name"`
+	Status     string        `json:"status"` // ok or failed
+	ErrorClass string        `json:"error_class"`
+	Error      string        `json:"error"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// PollResult is a row of the poll log, one per device poll. Status is ok,
+// partial when some collectors failed, failed or quarantined when the
+// device was not polled because it kept failing.
+type PollResult struct {
+	Time                int64              `ch:"time" json:"time"`
+	DeviceID            int32              `ch:"device_id" json:"device_id"`
+	PollerGroup         int32              `ch:"poller_group" json:"poller_group"`
+	Hostname            string             `ch:"hostname" json:"hostname"`
+	SysName             string             `ch:"sys_name" json:"sys_name"`
+	DurationMs          float64            `ch:"duration_ms" json:"duration_ms"`
+	Status              string             `ch:"status" json:"status"`
+	ErrorClass          string             `ch:"error_class" json:"error_class"`
+	Error               string             `ch:"error" json:"error"`
+	CollectorStatus     map[string]string  `ch:"collector_status" json:"collector_status"`
+	CollectorDurationMs map[string]float64 `ch:"collector_duration_ms" json:"collector_duration_ms"`
+	ConsecutiveFailures int32              `ch:"consecutive_failures" json:"consecutive_failures"`
+	QuarantinedUntil    int64              `ch:"quarantined_until" json:"quarantined_until"`
+	RateLimitWaitMs     float64            `ch:"rate_limit_wait_ms" json:"rate_limit_wait_ms"`
+}
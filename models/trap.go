@@ -0,0 +1,27 @@
+package models
+
+// Trap is a received SNMP trap or inform, decoded and matched to a device.
+// Traps from unknown sources are kept with DeviceID 0.
+type Trap struct {
+	Time        int64  `ch:"time" json:"time"`
+	DeviceID    int32  `ch:"device_id" json:"device_id"`
+	PollerGroup int32  `ch:"poller_group" json:"poller_group"`
+	Hostname    string `ch:"hostname" json:"hostname"`
+	SysName     string `ch:"sys_name" json:"sys_name"`
+	SourceAddr  string `ch:"source_addr" json:"source_addr"`
+	Version     string `ch:"version" json:"version"`
+	PduType     string `ch:"pdu_type" json:"pdu_type"` // trap or inform
+	TrapOid     string `ch:"trap_oid" json:"trap_oid"`
+	TrapName    string `ch:"trap_name" json:"trap_name"` // linkDown, coldStart, etc
+
+	// Decoded fields of the well known traps, empty if not applicable
+	IfIndex      int32  `ch:"if_index" json:"if_index"`
+	IfName       string `ch:"if_name" json:"if_name"`
+	AdminStatus  int32  `ch:"admin_status" json:"admin_status"`
+	OperStatus   int32  `ch:"oper_status" json:"oper_status"`
+	BgpPeer      string `ch:"bgp_peer" json:"bgp_peer"`
+	BgpPeerState int32  `ch:"bgp_peer_state" json:"bgp_peer_state"`
+
+	// Varbinds has all received variables as oid => printable value
+	Varbinds map[string]string `ch:"varbinds" json:"varbinds"`
+}
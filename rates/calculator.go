@@ -0,0 +1,185 @@
+package rates
+
+import (
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/snmp"
+	"go.uber.org/zap"
+)
+
+// RateDefinition is a rate computed from a counter, Bits is the counter
+// size to handle wraps, Multiplier converts units, e.g. octets to bits.
+// Names are column names of the interfaces table.
+type RateDefinition struct {
+	Name       string
+	Counter    string
+	Bits       uint
+	Multiplier float64
+}
+
+// RateDefinitions are rates stored next to raw counters, in table order.
+var RateDefinitions = []RateDefinition{
+	{Name: "in_bps", Counter: "ifHCInOctets", Bits: 64, Multiplier: 8},
+	{Name: "out_bps", Counter: "ifHCOutOctets", Bits: 64, Multiplier: 8},
+	{Name: "in_ucast_pps", Counter: "ifHCInUcastPkts", Bits: 64, Multiplier: 1},
+	{Name: "out_ucast_pps", Counter: "ifHCOutUcastPkts", Bits: 64, Multiplier: 1},
+	{Name: "in_multicast_pps", Counter: "ifHCInMulticastPkts", Bits: 64, Multiplier: 1},
+	{Name: "out_multicast_pps", Counter: "ifHCOutMulticastPkts", Bits: 64, Multiplier: 1},
+	{Name: "in_broadcast_pps", Counter: "ifHCInBroadcastPkts", Bits: 64, Multiplier: 1},
+	{Name: "out_broadcast_pps", Counter: "ifHCOutBroadcastPkts", Bits: 64, Multiplier: 1},
+	{Name: "in_errors_rate", Counter: "ifInErrors", Bits: 32, Multiplier: 1},
+	{Name: "out_errors_rate", Counter: "ifOutErrors", Bits: 32, Multiplier: 1},
+	{Name: "in_discards_rate", Counter: "ifInDiscards", Bits: 32, Multiplier: 1},
+	{Name: "out_discards_rate", Counter: "ifOutDiscards", Bits: 32, Multiplier: 1},
+}
+
+// timeticks are hundredths of a second
+const ticksPerSecond = 100
+
+type interfaceSample struct {
+	discontinuity *big.Int
+	counters      map[string]*big.Int
+}
+
+type deviceSample struct {
+	polledAt   time.Time
+	sysUpTime  uint32
+	interfaces map[int]interfaceSample
+}
+
+// Calculator keeps the previous counters of every device interface and sets
+// per second rates on the next poll. Deltas are discarded when the device
+// rebooted, the interface counters had a discontinuity or a 64 bit counter
+// went backwards, as those are resets rather than wraps.
+type Calculator struct {
+	logger *zap.Logger
+
+	lock    sync.Mutex
+	devices map[int32]deviceSample
+}
+
+func New(logger *zap.Logger) *Calculator {
+	return &Calculator{
+		logger:  logger,
+		devices: map[int32]deviceSample{},
+	}
+}
+
+// SetRates is a decorator which sets rates of polled interfaces, it must
+// run after counters are set.
+func (c *Calculator) SetRates(decorator snmp.DecorateFunc) snmp.DecorateFunc {
+	return func(metricsMap *models.SnmpInterfaceMetrics) error {
+		c.Compute(metricsMap)
+		return decorator(metricsMap)
+	}
+}
+
+// Compute sets rates on interfaces of the metrics and keeps the counters
+// for the next poll, polls without counters are ignored.
+func (c *Calculator) Compute(metricsMap *models.SnmpInterfaceMetrics) {
+	if !metricsMap.Collected(snmp.CollectorCounters) {
+		return
+	}
+	current := deviceSample{
+		polledAt:   metricsMap.PolledAt,
+		sysUpTime:  metricsMap.SysUpTime,
+		interfaces: make(map[int]interfaceSample, len(metricsMap.CountersMap)),
+	}
+	for ifIndex, iface := range metricsMap.CountersMap {
+		// storers fill missing counters with zeros, keep our own copy
+		counters := make(map[string]*big.Int, len(iface.Counters))
+		for name, value := range iface.Counters {
+			counters[name] = value
+		}
+		current.interfaces[ifIndex] = interfaceSample{
+			discontinuity: iface.Counters["ifCounterDiscontinuityTime"],
+			counters:      counters,
+		}
+	}
+
+	c.lock.Lock()
+	previous, ok := c.devices[metricsMap.DeviceID]
+	c.devices[metricsMap.DeviceID] = current
+	c.lock.Unlock()
+
+	if !ok || metricsMap.PolledAt.IsZero() {
+		return
+	}
+	elapsed := current.polledAt.Sub(previous.polledAt).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	metricsMap.RateInterval = elapsed
+	if rebooted(previous, current) {
+		c.logger.Info("device rebooted, discarding counter deltas", zap.Int32("device_id", metricsMap.DeviceID), zap.Uint32("sys_uptime", current.sysUpTime))
+		return
+	}
+
+	for ifIndex, iface := range metricsMap.CountersMap {
+		prev, ok := previous.interfaces[ifIndex]
+		if !ok {
+			continue
+		}
+		if !sameValue(prev.discontinuity, current.interfaces[ifIndex].discontinuity) {
+			c.logger.Debug("counter discontinuity, discarding deltas", zap.Int32("device_id", metricsMap.DeviceID), zap.Int("if_index", ifIndex))
+			continue
+		}
+
+		rates := make(map[string]float64, len(RateDefinitions))
+		for _, def := range RateDefinitions {
+			delta, ok := counterDelta(prev.counters[def.Counter], iface.Counters[def.Counter], def.Bits)
+			if !ok {
+				continue
+			}
+			rates[def.Name] = delta * def.Multiplier / elapsed
+		}
+		iface.Rates = rates
+		metricsMap.CountersMap[ifIndex] = iface
+	}
+}
+
+// rebooted compares sysUpTime with the wall clock, uptime lower than
+// expected is a reboot unless the 32 bit timeticks wrapped, which happens
+// every 497 days.
+func rebooted(previous, current deviceSample) bool {
+	if previous.sysUpTime == 0 || current.sysUpTime == 0 {
+		return false
+	}
+	if current.sysUpTime >= previous.sysUpTime {
+		return false
+	}
+	elapsedTicks := uint64(current.polledAt.Sub(previous.polledAt).Seconds() * ticksPerSecond)
+	wrapped := uint64(previous.sysUpTime)+elapsedTicks > 1<<32
+	return !wrapped
+}
+
+// counterDelta returns the increase of a counter. A 32 bit counter lower
+// than before wrapped if the wrapped delta is less than half of the range,
+// a 64 bit counter practically never wraps, so it was reset.
+func counterDelta(prev, cur *big.Int, bits uint) (float64, bool) {
+	if prev == nil || cur == nil {
+		return 0, false
+	}
+	delta := new(big.Int).Sub(cur, prev)
+	if delta.Sign() < 0 {
+		if bits == 64 {
+			return 0, false
+		}
+		delta.Add(delta, new(big.Int).Lsh(big.NewInt(1), bits))
+		if delta.Cmp(new(big.Int).Lsh(big.NewInt(1), bits-1)) > 0 {
+			return 0, false
+		}
+	}
+	value, _ := new(big.Float).SetInt(delta).Float64()
+	return value, true
+}
+
+func sameValue(a, b *big.Int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Cmp(b) == 0
+}
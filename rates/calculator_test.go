@@ -0,0 +1,116 @@
+package rates
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/snmp"
+	"go.uber.org/zap"
+)
+
+func TestCounterDelta(t *testing.T) {
+	max32 := int64(1<<32 - 1)
+	tests := []struct {
+		name      string
+		prev, cur *big.Int
+		bits      uint
+		want      float64
+		ok        bool
+	}{
+		{"increase", big.NewInt(100), big.NewInt(250), 64, 150, true},
+		{"unchanged", big.NewInt(100), big.NewInt(100), 32, 0, true},
+		{"32 bit wrap", big.NewInt(max32 - 9), big.NewInt(10), 32, 20, true},
+		{"32 bit wrap at zero", big.NewInt(max32), big.NewInt(0), 32, 1, true},
+		{"32 bit reset", big.NewInt(1_000_000_000), big.NewInt(5), 32, 0, false},
+		{"64 bit backwards is a reset", new(big.Int).Lsh(big.NewInt(1), 63), big.NewInt(10), 64, 0, false},
+		{"64 bit large increase", big.NewInt(0), new(big.Int).Lsh(big.NewInt(1), 40), 64, 1 << 40, true},
+		{"missing previous", nil, big.NewInt(10), 64, 0, false},
+		{"missing current", big.NewInt(10), nil, 32, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := counterDelta(tt.prev, tt.cur, tt.bits)
+			if ok != tt.ok || got != tt.want {
+				t.Fatalf("counterDelta() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRebooted(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		name         string
+		prev, cur    uint32
+		elapsed      time.Duration
+		wantRebooted bool
+	}{
+		{"uptime grows", 10_000, 16_000, time.Minute, false},
+		{"uptime went back", 1_000_000, 500, time.Minute, true},
+		{"timeticks wrapped", 1<<32 - 1000, 5000, time.Minute, false},
+		{"went back more than a wrap explains", 1<<32 - 1000, 5000, time.Second, true},
+		{"unknown previous uptime", 0, 500, time.Minute, false},
+		{"unknown current uptime", 1_000_000, 0, time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := deviceSample{polledAt: start, sysUpTime: tt.prev}
+			current := deviceSample{polledAt: start.Add(tt.elapsed), sysUpTime: tt.cur}
+			if got := rebooted(previous, current); got != tt.wantRebooted {
+				t.Fatalf("rebooted() = %v, want %v", got, tt.wantRebooted)
+			}
+		})
+	}
+}
+
+func metrics(polledAt time.Time, sysUpTime uint32, octets, discontinuity int64) *models.SnmpInterfaceMetrics {
+	return &models.SnmpInterfaceMetrics{
+		DeviceID:   1,
+		PolledAt:   polledAt,
+		SysUpTime:  sysUpTime,
+		Collectors: []models.CollectorResult{{Name: snmp.CollectorCounters, Status: snmp.CollectorOk}},
+		CountersMap: map[int]models.SnmpInterface{
+			1: {Counters: map[string]*big.Int{
+				"ifHCInOctets":               big.NewInt(octets),
+				"ifCounterDiscontinuityTime": big.NewInt(discontinuity),
+			}},
+		},
+	}
+}
+
+func TestComputeDiscardsResets(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		name      string
+		next      *models.SnmpInterfaceMetrics
+		wantRates bool
+	}{
+		{"steady", metrics(start.Add(10*time.Second), 2000, 2000, 0), true},
+		{"reboot", metrics(start.Add(10*time.Second), 50, 2000, 0), false},
+		{"discontinuity", metrics(start.Add(10*time.Second), 2000, 2000, 1500), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calc := New(zap.NewNop())
+			calc.Compute(metrics(start, 1000, 1000, 0))
+			calc.Compute(tt.next)
+
+			rates := tt.next.CountersMap[1].Rates
+			if !tt.wantRates {
+				if rates != nil {
+					t.Fatalf("want no rates, got %v", rates)
+				}
+				return
+			}
+			// 1000 octets in 10 seconds
+			if got := rates["in_bps"]; got != 800 {
+				t.Fatalf("in_bps = %v, want 800", got)
+			}
+			if tt.next.RateInterval != 10 {
+				t.Fatalf("rate interval = %v, want 10", tt.next.RateInterval)
+			}
+		})
+	}
+}
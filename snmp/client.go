@@ -1,6 +1,9 @@
 package snmp
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/gosnmp/gosnmp"
@@ -8,26 +11,45 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	defaultTimeout = 5 * time.Second
+	defaultRetries = 3
+)
+
+// Client is an snmp session of a device. A client can be shared between
+// collectors, requests are serialised by the lock.
 type Client struct {
-	client *gosnmp.GoSNMP
-	logger *zap.Logger
-	device *models.Device
+	lock        *sync.Mutex
+	client      *gosnmp.GoSNMP
+	logger      *zap.Logger
+	device      *models.Device
+	settings    *Settings
+	contextName string
+	// collector running, picks its context name, guarded by lock
+	collector string
+
+	resetRetried func()
+	// ends rate limiter waits of the poll, e.g. on shutdown
+	ctx context.Context
+	// time spent waiting for the rate limiter, guarded by lock
+	rateLimitWait time.Duration
+	walks         []WalkTiming
 }
 
-func New(device *models.Device, logger *zap.Logger) *Client {
+// New creates a client, a device without the credentials of its snmp
+// version returns ErrBadDevice.
+func New(device *models.Device, logger *zap.Logger, settings *Settings) (*Client, error) {
 	if device.Hostname == nil {
-		logger.Error("bad address")
-		return nil
+		return nil, fmt.Errorf("%w: no hostname", ErrBadDevice)
 	}
 	if device.SnmpVer == nil {
-		logger.Error("bad version")
-		return nil
+		return nil, fmt.Errorf("%w: no snmp version", ErrBadDevice)
 	}
 
 	g := &gosnmp.GoSNMP{
 		Port:                    161,
-		Retries:                 3,
-		Timeout:                 5 * time.Second,
+		Retries:                 settings.retries(),
+		Timeout:                 settings.timeout(device.DeviceID),
 		Transport:               "udp",
 		Target:                  *device.Hostname,
 		UseUnconnectedUDPSocket: true,
@@ -40,22 +62,28 @@ func New(device *models.Device, logger *zap.Logger) *Client {
 	case "v2c":
 		g.Version = gosnmp.Version2c
 		if device.Community == nil {
-			logger.Error("bad community for v2c, must have a community")
-			return nil
+			return nil, fmt.Errorf("%w: v2c without community", ErrBadDevice)
 		}
 		g.Community = *device.Community
 	case "v3":
 		if device.AuthLevel == nil || device.AuthName == nil || device.AuthPass == nil || device.CryptoPass == nil {
-			logger.Error("bad device", zap.Any("dev", device))
-			return nil
+			return nil, fmt.Errorf("%w: v3 without credentials", ErrBadDevice)
+		}
+		auth, err := AuthProtocol(strValue(device.AuthAlgo))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadDevice, err)
+		}
+		priv, err := PrivProtocol(strValue(device.CryptoAlgo))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadDevice, err)
 		}
 		g.Version = gosnmp.Version3
 		g.SecurityModel = gosnmp.UserSecurityModel
 		g.SecurityParameters = &gosnmp.UsmSecurityParameters{
 			UserName:                 *device.AuthName,
-			AuthenticationProtocol:   gosnmp.SHA,
+			AuthenticationProtocol:   auth,
 			AuthenticationPassphrase: *device.AuthPass,
-			PrivacyProtocol:          gosnmp.AES,
+			PrivacyProtocol:          priv,
 			PrivacyPassphrase:        *device.CryptoPass,
 		}
 
@@ -67,16 +95,87 @@ func New(device *models.Device, logger *zap.Logger) *Client {
 		case "authPriv":
 			g.MsgFlags = gosnmp.AuthPriv
 		default:
-			panic("bad security")
+			return nil, fmt.Errorf("%w: unknown v3 auth level %q", ErrBadDevice, *device.AuthLevel)
 		}
 	default:
-		logger.Error("bad prootcol")
+		return nil, fmt.Errorf("%w: unknown snmp version %q", ErrBadDevice, *device.SnmpVer)
+	}
+
+	c := &Client{
+		lock:        &sync.Mutex{},
+		client:      g,
+		logger:      logger,
+		device:      device,
+		settings:    settings,
+		contextName: settings.contextName(device.DeviceID),
+		ctx:         context.Background(),
+	}
+	c.presetEngine()
+	c.trackRtt()
+	c.limitRate()
+
+	return c, nil
+}
+
+// AuthProtocol maps a LibreNMS authalgo name, SHA when it is empty.
+func AuthProtocol(algo string) (gosnmp.SnmpV3AuthProtocol, error) {
+	switch algo {
+	case "", "SHA":
+		return gosnmp.SHA, nil
+	case "MD5":
+		return gosnmp.MD5, nil
+	case "SHA-224":
+		return gosnmp.SHA224, nil
+	case "SHA-256":
+		return gosnmp.SHA256, nil
+	case "SHA-384":
+		return gosnmp.SHA384, nil
+	case "SHA-512":
+		return gosnmp.SHA512, nil
+	default:
+		return 0, fmt.Errorf("unknown v3 auth algo %q", algo)
+	}
+}
+
+// PrivProtocol maps a LibreNMS cryptoalgo name, AES when it is empty. The
+// -C variants are the Cisco (Reeder) key extension.
+func PrivProtocol(algo string) (gosnmp.SnmpV3PrivProtocol, error) {
+	switch algo {
+	case "", "AES":
+		return gosnmp.AES, nil
+	case "DES":
+		return gosnmp.DES, nil
+	case "AES-192":
+		return gosnmp.AES192, nil
+	case "AES-256":
+		return gosnmp.AES256, nil
+	case "AES-192-C":
+		return gosnmp.AES192C, nil
+	case "AES-256-C":
+		return gosnmp.AES256C, nil
+	default:
+		return 0, fmt.Errorf("unknown v3 crypto algo %q", algo)
+	}
+}
+
+// connect opens the socket once, it is kept open between polls.
+func (c *Client) connect() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.client.Conn != nil {
 		return nil
 	}
+	return c.client.Connect()
+}
 
-	return &Client{
-		client: g,
-		logger: logger,
-		device: device,
+// Close closes the socket, the client connects again on the next poll.
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.client.Conn == nil {
+		return nil
 	}
+	err := c.client.Conn.Close()
+	c.client.Conn = nil
+	return err
 }
@@ -0,0 +1,35 @@
+package snmp
+
+import (
+	"time"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+)
+
+// Collector names in poll results.
+const (
+	CollectorInterfaces = "interfaces"
+	CollectorCounters   = "counters"
+	CollectorCpu        = "cpu"
+	CollectorOspf       = "ospf"
+)
+
+const (
+	CollectorOk     = "ok"
+	CollectorFailed = "failed"
+)
+
+// recordCollector adds the outcome of a collector to the metrics.
+func recordCollector(metricsMap *models.SnmpInterfaceMetrics, name string, started time.Time, err error) {
+	result := models.CollectorResult{
+		Name:     name,
+		Status:   CollectorOk,
+		Duration: time.Since(started),
+	}
+	if err != nil {
+		result.Status = CollectorFailed
+		result.ErrorClass = ClassifyError(err)
+		result.Error = err.Error()
+	}
+	metricsMap.Collectors = append(metricsMap.Collectors, result)
+}
@@ -1,8 +1,6 @@
 package snmp
 
 import (
-	"fmt"
-	"strconv"
 	"strings"
 	"time"
 
@@ -11,171 +9,214 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	CpuSourceHostResources = "HOST-RESOURCES-MIB"
+	CpuSourceCisco         = "CISCO-PROCESS-MIB"
+	CpuSourceJuniper       = "JUNIPER-MIB"
+	CpuSourceHuawei        = "HUAWEI-ENTITY-EXTENT-MIB"
+)
+
 var CpuOidMap = map[string]string{
-	"cpu": "1.3.6.1.2.1.25.3.3.1.2",
+	"hrProcessorLoad": ".1.3.6.1.2.1.25.3.3.1.2",
+	"hrDeviceDescr":   ".1.3.6.1.2.1.25.3.2.1.3",
+	"entPhysicalName": ".1.3.6.1.2.1.47.1.1.1.1.7",
+
+	"cpmCPUTotalPhysicalIndex": ".1.3.6.1.4.1.9.9.109.1.1.1.1.2",
+	"cpmCPUTotal1minRev":       ".1.3.6.1.4.1.9.9.109.1.1.1.1.7",
+	"cpmCPUTotal5minRev":       ".1.3.6.1.4.1.9.9.109.1.1.1.1.8",
+
+	"jnxOperatingDescr": ".1.3.6.1.4.1.2636.3.1.13.1.5",
+	"jnxOperatingCPU":   ".1.3.6.1.4.1.2636.3.1.13.1.8",
+
+	"hwEntityCpuUsage": ".1.3.6.1.4.1.2011.5.25.31.1.1.1.1.5",
+	"hwEntityMemSize":  ".1.3.6.1.4.1.2011.5.25.31.1.1.1.1.9",
+}
+
+// jnxContainersIndex of routing engines and FPCs, other operating table
+// rows are PSUs, fans, etc which report 0 cpu.
+var juniperCpuContainers = map[string]bool{
+	"7": true, // FPC
+	"9": true, // Routing Engine
 }
 
-// GetInterfacesMap builds an interface map setting correct indexes. This
-// closure should be called the last if you use composer/middleware style function.
-// it'll set initial map parameters such us device hostname, sysname, etc.
-func (c *Client) GetCpuMap(decorator DecorateFunc) DecorateFunc {
+type cpuCollector func(c *Client) ([]models.SnmpProcessor, error)
+
+// cpuCollectorsByOS maps LibreNMS os names to vendor collectors, any other
+// os is polled with HOST-RESOURCES-MIB. Arista EOS implements
+// hrProcessorLoad per core, so it does not need a vendor MIB.
+var cpuCollectorsByOS = map[string]cpuCollector{
+	"ios":        ciscoCpu,
+	"iosxe":      ciscoCpu,
+	"iosxr":      ciscoCpu,
+	"nxos":       ciscoCpu,
+	"asa":        ciscoCpu,
+	"junos":      juniperCpu,
+	"arista_eos": hostResourcesCpu,
+	"vrp":        huaweiCpu,
+}
+
+// SetCpu sets processors load using a collector chosen by device os, it
+// falls back to HOST-RESOURCES-MIB when the vendor table is empty. A failed
+// cpu walk is logged and does not fail the rest of the poll.
+func (c *Client) SetCpu(decorator DecorateFunc) DecorateFunc {
 	return func(metricsMap *models.SnmpInterfaceMetrics) error {
-		err := c.client.Connect()
-		if err != nil {
-			c.logger.Error("failed to connect", zap.Error(err))
-			return err
+		c.useCollector(CollectorCpu)
+		collector := hostResourcesCpu
+		if c.device.OS != nil {
+			if vendorCollector, ok := cpuCollectorsByOS[*c.device.OS]; ok {
+				collector = vendorCollector
+			}
 		}
 
-		pdu, err := c.walkOid(CpuOidMap["cpu"])
+		started := time.Now()
+		processors, err := collector(c)
+		if err == nil && len(processors) == 0 {
+			processors, err = hostResourcesCpu(c)
+		}
+		recordCollector(metricsMap, CollectorCpu, started, err)
 		if err != nil {
-			c.logger.Error("error walk", zap.Error(err))
-			return err
+			c.logger.Error("error walk cpu", zap.Error(err), zap.Int32("device_id", c.device.DeviceID))
+			return decorator(metricsMap)
 		}
 
-		if c.device != nil && c.device.Hostname != nil {
-			metricsMap.Hostname = *c.device.Hostname
-		}
-		if c.device != nil && c.device.SysName != nil {
-			metricsMap.SysName = *c.device.SysName
-		}
-		if c.device != nil && c.device.Hardware != nil {
-			metricsMap.Hardware = *c.device.Hardware
-		}
-		if c.device != nil && c.device.OS != nil {
-			metricsMap.OS = *c.device.OS
-		}
-		if c.device != nil && c.device.Serial != nil {
-			metricsMap.Serial = *c.device.Serial
-		}
-		if c.device != nil && c.device.UptimeSeconds != nil {
-			metricsMap.Uptime = *c.device.UptimeSeconds
-		}
-		if c.device != nil && c.device.Location != nil {
-			metricsMap.Location = *c.device.Location
-		}
-		if c.device != nil && c.device.SysDescr != nil {
-			metricsMap.SysDescr = *c.device.SysDescr
-		}
-		if c.device != nil && c.device.Lat != nil && c.device.Lng != nil {
-			metricsMap.Lat = *c.device.Lat
-			metricsMap.Lng = *c.device.Lng
-		}
+		metricsMap.Processors = processors
+		c.logger.Debug("set cpu metrics", zap.Int("processors", len(processors)))
+		return decorator(metricsMap)
+	}
+}
+
+func hostResourcesCpu(c *Client) ([]models.SnmpProcessor, error) {
+	pdu, err := c.walkOid(CpuOidMap["hrProcessorLoad"], CpuOidMap["hrDeviceDescr"])
+	if err != nil {
+		return nil, err
+	}
+	loads := columnValues(pdu, CpuOidMap["hrProcessorLoad"])
+	descrs := columnValues(pdu, CpuOidMap["hrDeviceDescr"])
+
+	processors := make([]models.SnmpProcessor, 0, len(loads))
+	for index, val := range loads {
+		processors = append(processors, models.SnmpProcessor{
+			Index:  index,
+			Descr:  stringValue(descrs[index]),
+			Load:   gosnmp.ToBigInt(val.Value).Int64(),
+			Source: CpuSourceHostResources,
+		})
+	}
+	return processors, nil
+}
 
-		metricsMap.CountersMap = make(map[int]models.SnmpInterface)
+// ciscoCpu uses 1 minute load to match hrProcessorLoad, 5 minute load is
+// used if the agent doesn't have the 1 minute one.
+func ciscoCpu(c *Client) ([]models.SnmpProcessor, error) {
+	pdu, err := c.walkOid(
+		CpuOidMap["cpmCPUTotal1minRev"],
+		CpuOidMap["cpmCPUTotal5minRev"],
+		CpuOidMap["cpmCPUTotalPhysicalIndex"],
+	)
+	if err != nil {
+		return nil, err
+	}
+	loads := columnValues(pdu, CpuOidMap["cpmCPUTotal1minRev"])
+	if len(loads) == 0 {
+		loads = columnValues(pdu, CpuOidMap["cpmCPUTotal5minRev"])
+	}
+	physIndexes := columnValues(pdu, CpuOidMap["cpmCPUTotalPhysicalIndex"])
 
-		for _, val := range pdu {
-			if val.Type != gosnmp.Integer {
-				// sanity check
-				c.logger.Error("not integer walk")
-				return ErrInterfaceIndexNotInteger
-			}
+	names := map[string]gosnmp.SnmpPDU{}
+	if len(physIndexes) > 0 {
+		namesPdu, err := c.walkOid(CpuOidMap["entPhysicalName"])
+		if err != nil {
+			return nil, err
+		}
+		names = columnValues(namesPdu, CpuOidMap["entPhysicalName"])
+	}
 
-			ifIndex, ok := val.Value.(int)
-			if !ok {
-				return ErrInterfaceIndexNotInteger
+	processors := make([]models.SnmpProcessor, 0, len(loads))
+	for index, val := range loads {
+		descr := "Processor " + index
+		if phys, ok := physIndexes[index]; ok {
+			if name := stringValue(names[gosnmp.ToBigInt(phys.Value).String()]); name != "" {
+				descr = name
 			}
-			metricsMap.CountersMap[ifIndex] = models.SnmpInterface{}
 		}
+		processors = append(processors, models.SnmpProcessor{
+			Index:  index,
+			Descr:  descr,
+			Load:   gosnmp.ToBigInt(val.Value).Int64(),
+			Source: CpuSourceCisco,
+		})
+	}
+	return processors, nil
+}
 
-		return decorator(metricsMap)
+func juniperCpu(c *Client) ([]models.SnmpProcessor, error) {
+	pdu, err := c.walkOid(CpuOidMap["jnxOperatingCPU"], CpuOidMap["jnxOperatingDescr"])
+	if err != nil {
+		return nil, err
 	}
+	loads := columnValues(pdu, CpuOidMap["jnxOperatingCPU"])
+	descrs := columnValues(pdu, CpuOidMap["jnxOperatingDescr"])
+
+	processors := make([]models.SnmpProcessor, 0, len(loads))
+	for index, val := range loads {
+		container := strings.SplitN(index, ".", 2)[0]
+		if !juniperCpuContainers[container] {
+			continue
+		}
+		processors = append(processors, models.SnmpProcessor{
+			Index:  index,
+			Descr:  stringValue(descrs[index]),
+			Load:   gosnmp.ToBigInt(val.Value).Int64(),
+			Source: CpuSourceJuniper,
+		})
+	}
+	return processors, nil
 }
 
-// SetCpuCounters sets cpu snmp counters
-func (c *Client) SetCpuCounters(decorator DecorateFunc) DecorateFunc {
-	return func(metricsMap *models.SnmpInterfaceMetrics) error {
-		defer func() {
-			c.logger.Info("close the conn")
-			c.client.Conn.Close()
-		}()
-		pdu, err := c.walkOid(
-			StrNameToOidMap["ifDescr"],
-			StrNameToOidMap["ifPhysAddress"],
-			StrNameToOidMap["ifAlias"],
-			StrNameToOidMap["ifAdminStatus"],
-			StrNameToOidMap["ifOperStatus"],
-			StrNameToOidMap["ifSpeed"],
-			StrNameToOidMap["ifMtu"],
-
-			StrNameToOidMap["ifInMulticastPkts"],
-			StrNameToOidMap["ifInBroadcastPkts"],
-			StrNameToOidMap["ifOutMulticastPkts"],
-			StrNameToOidMap["ifOutBroadcastPkts"],
-			StrNameToOidMap["ifHCInOctets"],
-			StrNameToOidMap["ifHCInUcastPkts"],
-			StrNameToOidMap["ifHCInMulticastPkts"],
-			StrNameToOidMap["ifHCInBroadcastPkts"],
-			StrNameToOidMap["ifHCOutOctets"],
-			StrNameToOidMap["ifHCOutUcastPkts"],
-			StrNameToOidMap["ifHCOutMulticastPkts"],
-			StrNameToOidMap["ifHCOutBroadcastPkts"],
-			StrNameToOidMap["ifHighSpeed"],
-			StrNameToOidMap["ifCounterDiscontinuityTime"],
-
-			StrNameToOidMap["ifInDiscards"],
-			StrNameToOidMap["ifInErrors"],
-			StrNameToOidMap["ifOutDiscards"],
-			StrNameToOidMap["ifOutErrors"],
-
-			StrNameToOidMap["lldpRemSysName"],
-		)
-		if err != nil {
-			c.logger.Error("counters bad error", zap.Error(err), zap.Any("device", c.device.SysName))
-			return err
+// huaweiCpu reads boards with memory, boards without a cpu report 0 usage
+// and 0 memory.
+func huaweiCpu(c *Client) ([]models.SnmpProcessor, error) {
+	pdu, err := c.walkOid(CpuOidMap["hwEntityCpuUsage"], CpuOidMap["hwEntityMemSize"], CpuOidMap["entPhysicalName"])
+	if err != nil {
+		return nil, err
+	}
+	loads := columnValues(pdu, CpuOidMap["hwEntityCpuUsage"])
+	memSizes := columnValues(pdu, CpuOidMap["hwEntityMemSize"])
+	names := columnValues(pdu, CpuOidMap["entPhysicalName"])
+
+	processors := make([]models.SnmpProcessor, 0, len(loads))
+	for index, val := range loads {
+		memSize, ok := memSizes[index]
+		if !ok || gosnmp.ToBigInt(memSize.Value).Sign() == 0 {
+			continue
 		}
-		metricsMap.Time = time.Now().UTC().Unix()
-
-		for _, val := range pdu {
-			myoid := val.Name
-			indexpos := strings.LastIndex(myoid, ".")
-			index, _ := strconv.Atoi(myoid[indexpos+1:])
-			partsMyOid := strings.Split(myoid, ".")
-			origOID := strings.Join(partsMyOid[0:len(partsMyOid)-1], ".")
-			if strings.Contains(origOID, StrNameToOidMap["lldpRemSysName"]) {
-				origOID = StrNameToOidMap["lldpRemSysName"]
-			}
-			name := reverseMap(StrNameToOidMap)[origOID]
-			switch name {
-			case "ifPhysAddress":
-				v := ""
-				switch val.Type {
-				case gosnmp.OctetString:
-					bytes := val.Value.([]byte)
-					split := ""
-					for _, b := range bytes {
-						if v != "" {
-							split = ":"
-						}
-						v += fmt.Sprintf(split+"%x", b)
-					}
-				default:
-					v = fmt.Sprint(val.Value)
-				}
-				metricsMap.SetMacAddress(v, index)
-			case "ifAlias":
-				metricsMap.SetIfAlias(string(val.Value.([]byte)), index)
-			case "ifDescr":
-				metricsMap.SetIfName(string(val.Value.([]byte)), index)
-			case "ifAdminStatus":
-				intVal := gosnmp.ToBigInt(val.Value)
-				metricsMap.SetAdminStatus(intVal.Int64() == 1, index)
-			case "ifOperStatus":
-				intVal := gosnmp.ToBigInt(val.Value)
-				metricsMap.SetOperStatus(intVal.Int64() == 1, index)
-			case "ifSpeed":
-				intVal := gosnmp.ToBigInt(val.Value)
-				metricsMap.SetSpeed(intVal.Int64(), index)
-			case "ifMtu":
-				intVal := gosnmp.ToBigInt(val.Value)
-				metricsMap.SetMtu(intVal.Int64(), index)
-			case "lldpRemSysName":
-				metricsMap.SetNeighbour(string(val.Value.([]byte)), index)
-			default:
-				intVal := gosnmp.ToBigInt(val.Value)
-				metricsMap.SetCounters(intVal, index, name)
-			}
+		processors = append(processors, models.SnmpProcessor{
+			Index:  index,
+			Descr:  stringValue(names[index]),
+			Load:   gosnmp.ToBigInt(val.Value).Int64(),
+			Source: CpuSourceHuawei,
+		})
+	}
+	return processors, nil
+}
+
+// columnValues returns pdus of the column keyed by the row index, which
+// is the rest of the oid after the column oid.
+func columnValues(pdu []gosnmp.SnmpPDU, column string) map[string]gosnmp.SnmpPDU {
+	values := map[string]gosnmp.SnmpPDU{}
+	prefix := column + "."
+	for _, val := range pdu {
+		if strings.HasPrefix(val.Name, prefix) {
+			values[strings.TrimPrefix(val.Name, prefix)] = val
 		}
+	}
+	return values
+}
 
-		return decorator(metricsMap)
+func stringValue(val gosnmp.SnmpPDU) string {
+	bytes, ok := val.Value.([]byte)
+	if !ok {
+		return ""
 	}
+	return string(bytes)
 }
@@ -0,0 +1,214 @@
+package snmp
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"go.uber.org/zap"
+)
+
+var ErrEngineIDMismatch = errors.New("snmp engine id does not match the pinned engine id")
+
+// EngineInfo is discovered SNMPv3 authoritative engine state of an agent.
+type EngineInfo struct {
+	EngineID string
+	Boots    uint32
+	Time     uint32
+	Updated  time.Time
+}
+
+// EngineCache keeps discovered engine ids per device between polls, so we
+// can skip discovery and notice when an agent's engine id changes, which
+// usually means the device was replaced.
+type EngineCache struct {
+	lock    sync.Mutex
+	engines map[int32]EngineInfo
+}
+
+func NewEngineCache() *EngineCache {
+	return &EngineCache{
+		engines: map[int32]EngineInfo{},
+	}
+}
+
+func (e *EngineCache) Get(deviceID int32) (EngineInfo, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	info, ok := e.engines[deviceID]
+	return info, ok
+}
+
+// Set stores engine info and returns what was cached before.
+func (e *EngineCache) Set(deviceID int32, info EngineInfo) (EngineInfo, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	prev, ok := e.engines[deviceID]
+	e.engines[deviceID] = info
+	return prev, ok
+}
+
+func (e *EngineCache) Delete(deviceID int32) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	delete(e.engines, deviceID)
+}
+
+// Settings are options shared by all snmp clients. Context names and
+// engine ids are looked up by device id, ContextName is the default.
+// CollectorContexts are context names by collector name, they take
+// precedence over the device context in requests of that collector.
+type Settings struct {
+	ContextName       string
+	ContextNames      map[int32]string
+	CollectorContexts map[string]string
+	// EngineIDs are hex encoded expected engine ids
+	EngineIDs map[int32]string
+	Engines   *EngineCache
+	// EnforceEngineIDs fails polls on an unexpected engine id, otherwise it
+	// is only logged
+	EnforceEngineIDs bool
+
+	// Timeout is used until we have enough response time samples, then the
+	// timeout is derived from Rtt statistics within Min and Max.
+	Timeout    time.Duration
+	MinTimeout time.Duration
+	MaxTimeout time.Duration
+	Timeouts   map[int32]time.Duration
+	Retries    int
+	// after so many timed out requests the remaining walks of a poll are
+	// skipped, 0 disables it
+	MaxConsecutiveTimeouts int
+	Rtt                    *RttTracker
+	// Limiter limits packets sent, nil is unlimited
+	Limiter *RateLimiter
+	// TraceWalks records timings of every walk, see Client.TakeWalks
+	TraceWalks bool
+}
+
+func (s *Settings) contextName(deviceID int32) string {
+	if s == nil {
+		return ""
+	}
+	if name, ok := s.ContextNames[deviceID]; ok {
+		return name
+	}
+	return s.ContextName
+}
+
+func (s *Settings) pinnedEngineID(deviceID int32) (string, error) {
+	if s == nil || s.EngineIDs[deviceID] == "" {
+		return "", nil
+	}
+	engineID, err := hex.DecodeString(s.EngineIDs[deviceID])
+	if err != nil {
+		return "", err
+	}
+	return string(engineID), nil
+}
+
+// useCollector makes the following requests use the context name of the
+// collector, if there is one. Collectors of a poll run one after another.
+func (c *Client) useCollector(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.collector = name
+}
+
+// requestContext is the context name of the current collector or of the
+// device, called with the lock held.
+func (c *Client) requestContext() string {
+	if c.settings != nil {
+		if name, ok := c.settings.CollectorContexts[c.collector]; ok {
+			return name
+		}
+	}
+	return c.contextName
+}
+
+// presetEngine uses the cached engine id so v3 discovery is skipped, agents
+// answer with notInTimeWindow report if boots or time are stale, and gosnmp
+// retries with the reported values.
+func (c *Client) presetEngine() {
+	if c.settings == nil || c.settings.Engines == nil {
+		return
+	}
+	usm, ok := c.client.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	if !ok {
+		return
+	}
+	info, ok := c.settings.Engines.Get(c.device.DeviceID)
+	if !ok {
+		return
+	}
+	usm.AuthoritativeEngineID = info.EngineID
+	usm.AuthoritativeEngineBoots = info.Boots
+	usm.AuthoritativeEngineTime = info.Time
+	if c.client.ContextEngineID == "" {
+		c.client.ContextEngineID = info.EngineID
+	}
+}
+
+// forgetEngine drops the cached engine id after a failed request, a stale
+// engine id is not rediscovered otherwise.
+func (c *Client) forgetEngine() {
+	if c.settings == nil || c.settings.Engines == nil || c.client.Version != gosnmp.Version3 {
+		return
+	}
+	c.settings.Engines.Delete(c.device.DeviceID)
+}
+
+// checkEngine caches the engine id the agent answered with and compares it
+// to the previous and to the pinned one.
+func (c *Client) checkEngine() error {
+	usm, ok := c.client.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	if !ok || usm.AuthoritativeEngineID == "" {
+		return nil
+	}
+
+	pinned, err := c.settings.pinnedEngineID(c.device.DeviceID)
+	if err != nil {
+		c.logger.Error("bad pinned engine id", zap.Error(err), zap.Int32("device_id", c.device.DeviceID))
+	} else if pinned != "" && pinned != usm.AuthoritativeEngineID {
+		c.logger.Warn("snmp engine id differs from the pinned one, device could be replaced",
+			zap.Int32("device_id", c.device.DeviceID),
+			zap.String("pinned", hex.EncodeToString([]byte(pinned))),
+			zap.String("engine_id", hex.EncodeToString([]byte(usm.AuthoritativeEngineID))),
+		)
+		if c.settings.EnforceEngineIDs {
+			return ErrEngineIDMismatch
+		}
+	}
+
+	if c.settings == nil || c.settings.Engines == nil {
+		return nil
+	}
+	prev, ok := c.settings.Engines.Set(c.device.DeviceID, EngineInfo{
+		EngineID: usm.AuthoritativeEngineID,
+		Boots:    usm.AuthoritativeEngineBoots,
+		Time:     usm.AuthoritativeEngineTime,
+		Updated:  time.Now(),
+	})
+	switch {
+	case !ok:
+	case prev.EngineID != usm.AuthoritativeEngineID:
+		c.logger.Warn("snmp engine id changed between polls, device could be replaced",
+			zap.Int32("device_id", c.device.DeviceID),
+			zap.String("previous", hex.EncodeToString([]byte(prev.EngineID))),
+			zap.String("engine_id", hex.EncodeToString([]byte(usm.AuthoritativeEngineID))),
+		)
+		if c.client.ContextEngineID == prev.EngineID {
+			c.client.ContextEngineID = usm.AuthoritativeEngineID
+		}
+	case prev.Boots != usm.AuthoritativeEngineBoots:
+		c.logger.Info("snmp engine rebooted",
+			zap.Int32("device_id", c.device.DeviceID),
+			zap.Uint32("previous_boots", prev.Boots),
+			zap.Uint32("boots", usm.AuthoritativeEngineBoots),
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package snmp
+
+import (
+	"errors"
+	"net"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// Error classes of a failed poll, the empty class means no error.
+const (
+	ErrorClassNone      = ""
+	ErrorClassTimeout   = "timeout"
+	ErrorClassAuth      = "auth_failure"
+	ErrorClassBadConfig = "bad_config"
+	ErrorClassNetwork   = "network"
+	ErrorClassAgent     = "agent_error"
+)
+
+var authErrors = []error{
+	gosnmp.ErrWrongDigest,
+	gosnmp.ErrUnknownUsername,
+	gosnmp.ErrDecryption,
+	gosnmp.ErrUnknownSecurityLevel,
+	gosnmp.ErrUnknownSecurityModels,
+	gosnmp.ErrUnknownEngineID,
+	gosnmp.ErrNotInTimeWindow,
+	ErrEngineIDMismatch,
+}
+
+// ClassifyError tells why a device poll failed. v1 and v2c agents drop
+// requests with a wrong community, so those are timeouts too.
+func ClassifyError(err error) string {
+	if err == nil {
+		return ErrorClassNone
+	}
+	if errors.Is(err, ErrBadDevice) {
+		return ErrorClassBadConfig
+	}
+	for _, authErr := range authErrors {
+		if errors.Is(err, authErr) {
+			return ErrorClassAuth
+		}
+	}
+	if IsTimeout(err) {
+		return ErrorClassTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrorClassNetwork
+	}
+	return ErrorClassAgent
+}
@@ -4,6 +4,7 @@ import (
 	"math/big"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gosnmp/gosnmp"
 	"go.uber.org/zap"
@@ -65,19 +66,96 @@ func (c *Client) walkOid(oid string, otherOids ...string) ([]gosnmp.SnmpPDU, err
 	inputOids := []string{oid}
 	inputOids = append(inputOids, otherOids...)
 
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.client.ContextName = c.requestContext()
+	if err := c.beforeWalk(); err != nil {
+		return nil, err
+	}
+
 	pdus := []gosnmp.SnmpPDU{}
 	for _, oid := range inputOids {
+		started := time.Now()
 		pdu, err := c.client.WalkAll(oid)
+		err = requestError(err)
+		c.traceWalk(oid, started, len(pdu), err)
 		if err != nil {
 			c.logger.Error("bad response", zap.Error(err), zap.Any("device", *c.device.SysName), zap.Any("oid", oid), zap.Any("other oids", otherOids))
+			c.forgetEngine()
+			c.afterWalkError(err)
 			return nil, err
 		}
 		pdus = append(pdus, pdu...)
 	}
 
+	if err := c.checkEngine(); err != nil {
+		return nil, err
+	}
+
 	return pdus, nil
 }
 
+// getOid gets scalar oids of an snmp device
+func (c *Client) getOid(oids ...string) ([]gosnmp.SnmpPDU, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.client.ContextName = c.requestContext()
+	if err := c.beforeWalk(); err != nil {
+		return nil, err
+	}
+
+	started := time.Now()
+	pdu, err := c.client.Get(oids)
+	err = requestError(err)
+	if err != nil {
+		c.traceWalk(strings.Join(oids, ","), started, 0, err)
+		c.logger.Error("bad response", zap.Error(err), zap.Any("device", c.device.SysName), zap.Any("oids", oids))
+		c.forgetEngine()
+		c.afterWalkError(err)
+		return nil, err
+	}
+
+	c.traceWalk(strings.Join(oids, ","), started, len(pdu.Variables), nil)
+
+	if err := c.checkEngine(); err != nil {
+		return nil, err
+	}
+
+	return pdu.Variables, nil
+}
+
+// WalkTiming is a walk or get of a poll, recorded with Settings.TraceWalks.
+type WalkTiming struct {
+	Oid      string        `json:"oid"`
+	Duration time.Duration `json:"duration"`
+	Pdus     int           `json:"pdus"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func (c *Client) traceWalk(oid string, started time.Time, pdus int, err error) {
+	if c.settings == nil || !c.settings.TraceWalks {
+		return
+	}
+	walk := WalkTiming{
+		Oid:      oid,
+		Duration: time.Since(started),
+		Pdus:     pdus,
+	}
+	if err != nil {
+		walk.Error = err.Error()
+	}
+	c.walks = append(c.walks, walk)
+}
+
+// TakeWalks returns walks recorded since the previous call.
+func (c *Client) TakeWalks() []WalkTiming {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	walks := c.walks
+	c.walks = nil
+	return walks
+}
+
 func reverseMap(m map[string]string) map[string]string {
 	n := make(map[string]string, len(m))
 	for k, v := range m {
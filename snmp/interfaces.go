@@ -12,6 +12,7 @@ import (
 const (
 	ifTableOid   = "1.3.6.1.2.1.2.2.1.1"
 	ifTableAlias = "1.3.6.1.2.1.2.2.1.2"
+	sysUpTimeOid = ".1.3.6.1.2.1.1.3.0"
 )
 
 var (
@@ -69,49 +70,71 @@ var StrNameToOidMap = map[string]string{
 // it'll set initial map parameters such us device hostname, sysname, etc.
 func (c *Client) GetInterfacesMap(decorator DecorateFunc) DecorateFunc {
 	return func(metricsMap *models.SnmpInterfaceMetrics) error {
-		err := c.client.Connect()
+		c.useCollector(CollectorInterfaces)
+		started := time.Now()
+		err := c.interfacesMap(metricsMap)
+		recordCollector(metricsMap, CollectorInterfaces, started, err)
 		if err != nil {
-			c.logger.Error("failed to connect", zap.Error(err))
-			return err
-		}
-
-		pdu, err := c.walkOid(StrNameToOidMap["ifIndex"])
-		if err != nil {
-			c.logger.Error("error walk", zap.Error(err))
 			return err
 		}
+		return decorator(metricsMap)
+	}
+}
 
-		setDeviceDataForInterfaces(metricsMap, c.device)
+func (c *Client) interfacesMap(metricsMap *models.SnmpInterfaceMetrics) error {
+	err := c.connect()
+	if err != nil {
+		c.logger.Error("failed to connect", zap.Error(err))
+		return err
+	}
 
-		metricsMap.CountersMap = make(map[int]models.SnmpInterface)
+	pdu, err := c.walkOid(StrNameToOidMap["ifIndex"])
+	if err != nil {
+		c.logger.Error("error walk", zap.Error(err))
+		return err
+	}
 
-		for _, val := range pdu {
-			if val.Type != gosnmp.Integer {
-				// sanity check
-				c.logger.Error("not integer walk")
-				return ErrInterfaceIndexNotInteger
-			}
+	setDeviceDataForInterfaces(metricsMap, c.device)
+	// counters set their own time, they may not run on every poll
+	metricsMap.Time = time.Now().UTC().Unix()
 
-			ifIndex, ok := val.Value.(int)
-			if !ok {
-				return ErrInterfaceIndexNotInteger
-			}
-			metricsMap.CountersMap[ifIndex] = models.SnmpInterface{}
+	// sysUpTime tells counter rates that the device rebooted
+	uptime, err := c.getOid(sysUpTimeOid)
+	if err != nil {
+		c.logger.Error("error get sysUpTime", zap.Error(err))
+		return err
+	}
+	for _, val := range uptime {
+		if val.Type == gosnmp.TimeTicks {
+			metricsMap.SysUpTime = uint32(gosnmp.ToBigInt(val.Value).Uint64())
 		}
+	}
 
-		c.logger.Debug("got interface indexes", zap.Any("indexes", len(metricsMap.CountersMap)))
+	metricsMap.CountersMap = make(map[int]models.SnmpInterface)
 
-		return decorator(metricsMap)
+	for _, val := range pdu {
+		if val.Type != gosnmp.Integer {
+			// sanity check
+			c.logger.Error("not integer walk")
+			return ErrInterfaceIndexNotInteger
+		}
+
+		ifIndex, ok := val.Value.(int)
+		if !ok {
+			return ErrInterfaceIndexNotInteger
+		}
+		metricsMap.CountersMap[ifIndex] = models.SnmpInterface{}
 	}
+
+	c.logger.Debug("got interface indexes", zap.Any("indexes", len(metricsMap.CountersMap)))
+
+	return nil
 }
 
 // SetCounters sets snmp counters for oids from 10 to 21
 func (c *Client) SetCounters(decorator DecorateFunc) DecorateFunc {
 	return func(metricsMap *models.SnmpInterfaceMetrics) error {
-		defer func() {
-			c.logger.Info("close the conn")
-			c.client.Conn.Close()
-		}()
+		c.useCollector(CollectorCounters)
 		oids := []string{}
 		for k, v := range StrNameToOidMap {
 			if k == "ifDescr" {
@@ -120,12 +143,15 @@ func (c *Client) SetCounters(decorator DecorateFunc) DecorateFunc {
 			oids = append(oids, v)
 		}
 
+		started := time.Now()
 		pdu, err := c.walkOid(StrNameToOidMap["ifDescr"], oids...)
+		recordCollector(metricsMap, CollectorCounters, started, err)
 		if err != nil {
 			c.logger.Error("counters bad error", zap.Error(err), zap.Any("device", c.device.SysName))
 			return err
 		}
-		metricsMap.Time = time.Now().UTC().Unix()
+		metricsMap.PolledAt = time.Now()
+		metricsMap.Time = metricsMap.PolledAt.UTC().Unix()
 
 		setPduMetricsMap(metricsMap, pdu)
 		c.logger.Debug("set pdu metrics", zap.Any("metrics_count", len(metricsMap.CountersMap)))
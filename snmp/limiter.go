@@ -0,0 +1,205 @@
+package snmp
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/logingood/yt-snmp-go-poller/models"
+)
+
+// RateLimiter limits snmp packets per second of all devices and of every
+// device, retries included. A device limit is its own, its os's or the
+// default, in this order, 0 is unlimited.
+type RateLimiter struct {
+	global      *tokenBucket
+	deviceRate  float64
+	deviceRates map[int32]float64
+	osRates     map[string]float64
+
+	lock    sync.Mutex
+	devices map[int32]*tokenBucket
+	stats   RateLimitStats
+}
+
+// RateLimitStats are totals since start.
+type RateLimitStats struct {
+	Packets int64
+	Waits   int64
+	Waited  time.Duration
+}
+
+// NewRateLimiter creates a limiter, the global limit allows bursts of up to
+// a second of packets, devices are limited without bursts.
+func NewRateLimiter(globalRate, deviceRate float64, deviceRates map[int32]float64, osRates map[string]float64) *RateLimiter {
+	l := &RateLimiter{
+		deviceRate:  deviceRate,
+		deviceRates: deviceRates,
+		osRates:     osRates,
+		devices:     map[int32]*tokenBucket{},
+	}
+	if globalRate > 0 {
+		l.global = newTokenBucket(globalRate, math.Max(1, globalRate), time.Now())
+	}
+	return l
+}
+
+// Wait blocks until a packet may be sent to the device or ctx is done and
+// returns how long it waited.
+func (l *RateLimiter) Wait(ctx context.Context, device *models.Device) time.Duration {
+	l.lock.Lock()
+	reserved := time.Duration(0)
+	if bucket := l.device(device); bucket != nil {
+		reserved = bucket.reserve(time.Now())
+	}
+	l.lock.Unlock()
+	wait := sleep(ctx, reserved)
+
+	if l.global != nil && ctx.Err() == nil {
+		l.lock.Lock()
+		reserved = l.global.reserve(time.Now())
+		l.lock.Unlock()
+		wait += sleep(ctx, reserved)
+	}
+
+	l.lock.Lock()
+	l.stats.Packets++
+	if wait > 0 {
+		l.stats.Waits++
+		l.stats.Waited += wait
+	}
+	l.lock.Unlock()
+	return wait
+}
+
+// Stats returns totals since start.
+func (l *RateLimiter) Stats() RateLimitStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.stats
+}
+
+// Retain forgets devices which are not in the list anymore.
+func (l *RateLimiter) Retain(devices []models.Device) {
+	keep := make(map[int32]struct{}, len(devices))
+	for _, dev := range devices {
+		keep[dev.DeviceID] = struct{}{}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for deviceID := range l.devices {
+		if _, ok := keep[deviceID]; !ok {
+			delete(l.devices, deviceID)
+		}
+	}
+}
+
+// device returns the bucket of a device, nil if it is unlimited. The bucket
+// is replaced when the device limit changes.
+func (l *RateLimiter) device(device *models.Device) *tokenBucket {
+	rate := l.rate(device)
+	bucket, ok := l.devices[device.DeviceID]
+	if rate <= 0 {
+		if ok {
+			delete(l.devices, device.DeviceID)
+		}
+		return nil
+	}
+	if !ok || bucket.rate != rate {
+		bucket = newTokenBucket(rate, 1, time.Now())
+		l.devices[device.DeviceID] = bucket
+	}
+	return bucket
+}
+
+func (l *RateLimiter) rate(device *models.Device) float64 {
+	if rate, ok := l.deviceRates[device.DeviceID]; ok {
+		return rate
+	}
+	if device.OS != nil {
+		if rate, ok := l.osRates[*device.OS]; ok {
+			return rate
+		}
+	}
+	return l.deviceRate
+}
+
+// sleep waits for d or until ctx is done and returns how long it waited.
+func sleep(ctx context.Context, d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	started := time.Now()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return time.Since(started)
+}
+
+// tokenBucket hands out tokens at rate per second up to burst. A reserved
+// token may be in the future, the caller waits for it, so waiting callers
+// are served in order.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// reserve takes a token and returns how long to wait until it is due.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// limitRate hooks gosnmp to wait for the limiter before every packet. The
+// request deadline is set before the hook, it is moved so waiting does not
+// count towards the timeout. Once the poll ctx is done packets are sent
+// without waiting, so polls in flight finish on shutdown.
+func (c *Client) limitRate() {
+	if c.settings == nil || c.settings.Limiter == nil {
+		return
+	}
+	c.client.PreSend = func(g *gosnmp.GoSNMP) {
+		waited := c.settings.Limiter.Wait(c.ctx, c.device)
+		if waited == 0 {
+			return
+		}
+		c.rateLimitWait += waited
+		if g.Conn != nil {
+			g.Conn.SetDeadline(time.Now().Add(g.Timeout))
+		}
+	}
+}
+
+// TakeRateLimitWait returns time spent waiting for the rate limiter since
+// the previous call.
+func (c *Client) TakeRateLimitWait() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	waited := c.rateLimitWait
+	c.rateLimitWait = 0
+	return waited
+}
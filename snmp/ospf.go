@@ -0,0 +1,223 @@
+package snmp
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"go.uber.org/zap"
+)
+
+var OspfOidMap = map[string]string{
+	// OSPF-MIB
+	"ospfRouterId":   ".1.3.6.1.2.1.14.1.1",
+	"ospfIfAreaId":   ".1.3.6.1.2.1.14.7.1.3",
+	"ospfNbrRtrId":   ".1.3.6.1.2.1.14.10.1.3",
+	"ospfNbrState":   ".1.3.6.1.2.1.14.10.1.6",
+	"ipAdEntNetMask": ".1.3.6.1.2.1.4.20.1.3",
+
+	// OSPFV3-MIB
+	"ospfv3RouterId":   ".1.3.6.1.2.1.191.1.1.1",
+	"ospfv3IfAreaId":   ".1.3.6.1.2.1.191.1.7.1.3",
+	"ospfv3NbrAddress": ".1.3.6.1.2.1.191.1.9.1.5",
+	"ospfv3NbrState":   ".1.3.6.1.2.1.191.1.9.1.8",
+}
+
+// OspfNbrStates are ospfNbrState and ospfv3NbrState values.
+var OspfNbrStates = map[int32]string{
+	1: "down",
+	2: "attempt",
+	3: "init",
+	4: "twoWay",
+	5: "exchangeStart",
+	6: "exchange",
+	7: "loading",
+	8: "full",
+}
+
+// SetOspf sets OSPFv2 and OSPFv3 neighbours, devices without OSPF have
+// empty tables. A failed walk is logged and leaves neighbours nil, it does
+// not fail the poll.
+func (c *Client) SetOspf(decorator DecorateFunc) DecorateFunc {
+	return func(metricsMap *models.SnmpInterfaceMetrics) error {
+		c.useCollector(CollectorOspf)
+		started := time.Now()
+		now := started.UTC().Unix()
+
+		v2, err := ospfv2Neighbours(c)
+		if err != nil {
+			recordCollector(metricsMap, CollectorOspf, started, err)
+			c.logger.Error("error walk ospf", zap.Error(err), zap.Int32("device_id", c.device.DeviceID))
+			return decorator(metricsMap)
+		}
+		v3, err := ospfv3Neighbours(c)
+		recordCollector(metricsMap, CollectorOspf, started, err)
+		if err != nil {
+			c.logger.Error("error walk ospfv3", zap.Error(err), zap.Int32("device_id", c.device.DeviceID))
+			return decorator(metricsMap)
+		}
+
+		// not nil even if there are no neighbours, nil means we don't know
+		neighbours := make([]models.OspfNeighbour, 0, len(v2)+len(v3))
+		neighbours = append(neighbours, v2...)
+		neighbours = append(neighbours, v3...)
+		for i := range neighbours {
+			neighbours[i].Time = now
+			neighbours[i].DeviceID = metricsMap.DeviceID
+			neighbours[i].PollerGroup = metricsMap.PollerGroup
+			neighbours[i].Hostname = metricsMap.Hostname
+			neighbours[i].SysName = metricsMap.SysName
+		}
+		metricsMap.Ospf = neighbours
+
+		c.logger.Debug("set ospf neighbours", zap.Int("neighbours", len(neighbours)))
+		return decorator(metricsMap)
+	}
+}
+
+// ospfv2Neighbours reads ospfNbrTable, indexed by neighbour ip and
+// addressless index. The table has no area, so it is taken from the ospf
+// interface whose subnet has the neighbour address.
+func ospfv2Neighbours(c *Client) ([]models.OspfNeighbour, error) {
+	pdu, err := c.walkOid(OspfOidMap["ospfNbrState"], OspfOidMap["ospfNbrRtrId"])
+	if err != nil {
+		return nil, err
+	}
+	states := columnValues(pdu, OspfOidMap["ospfNbrState"])
+	if len(states) == 0 {
+		return nil, nil
+	}
+	routerIDs := columnValues(pdu, OspfOidMap["ospfNbrRtrId"])
+
+	pdu, err = c.walkOid(OspfOidMap["ospfRouterId"], OspfOidMap["ospfIfAreaId"], OspfOidMap["ipAdEntNetMask"])
+	if err != nil {
+		return nil, err
+	}
+	routerID := ""
+	if ids := columnValues(pdu, OspfOidMap["ospfRouterId"]); len(ids) > 0 {
+		routerID = ipValue(ids["0"])
+	}
+	areas := columnValues(pdu, OspfOidMap["ospfIfAreaId"])
+	masks := columnValues(pdu, OspfOidMap["ipAdEntNetMask"])
+
+	neighbours := make([]models.OspfNeighbour, 0, len(states))
+	for index, val := range states {
+		// index is ospfNbrIpAddr.ospfNbrAddressLessIndex
+		parts := strings.Split(index, ".")
+		if len(parts) < 5 {
+			continue
+		}
+		address := strings.Join(parts[:4], ".")
+		state := int32(gosnmp.ToBigInt(val.Value).Int64())
+		neighbours = append(neighbours, models.OspfNeighbour{
+			Version:           2,
+			RouterID:          routerID,
+			NeighbourRouterID: ipValue(routerIDs[index]),
+			NeighbourAddress:  address,
+			AreaID:            ospfv2Area(address, areas, masks),
+			State:             state,
+			StateName:         OspfNbrStates[state],
+		})
+	}
+	return neighbours, nil
+}
+
+// ospfv2Area finds the area of the interface the neighbour is connected to,
+// ospfIfTable index is ospfIfIpAddress.ospfAddressLessIf.
+func ospfv2Area(address string, areas, masks map[string]gosnmp.SnmpPDU) string {
+	ip := net.ParseIP(address)
+	for index, area := range areas {
+		parts := strings.Split(index, ".")
+		if len(parts) < 5 {
+			continue
+		}
+		ifAddress := strings.Join(parts[:4], ".")
+		mask, ok := masks[ifAddress]
+		if !ok {
+			continue
+		}
+		network := net.IPNet{
+			IP:   net.ParseIP(ifAddress),
+			Mask: net.IPMask(net.ParseIP(ipValue(mask)).To4()),
+		}
+		if ip != nil && network.Contains(ip) {
+			return ipValue(area)
+		}
+	}
+	return ""
+}
+
+// ospfv3Neighbours reads ospfv3NbrTable, indexed by ifIndex, instance id
+// and neighbour router id. Router and area ids are Unsigned32.
+func ospfv3Neighbours(c *Client) ([]models.OspfNeighbour, error) {
+	pdu, err := c.walkOid(OspfOidMap["ospfv3NbrState"], OspfOidMap["ospfv3NbrAddress"])
+	if err != nil {
+		return nil, err
+	}
+	states := columnValues(pdu, OspfOidMap["ospfv3NbrState"])
+	if len(states) == 0 {
+		return nil, nil
+	}
+	addresses := columnValues(pdu, OspfOidMap["ospfv3NbrAddress"])
+
+	pdu, err = c.walkOid(OspfOidMap["ospfv3RouterId"], OspfOidMap["ospfv3IfAreaId"])
+	if err != nil {
+		return nil, err
+	}
+	routerID := ""
+	if ids := columnValues(pdu, OspfOidMap["ospfv3RouterId"]); len(ids) > 0 {
+		routerID = uint32ToIP(ids["0"].Value)
+	}
+	areas := columnValues(pdu, OspfOidMap["ospfv3IfAreaId"])
+
+	neighbours := make([]models.OspfNeighbour, 0, len(states))
+	for index, val := range states {
+		parts := strings.Split(index, ".")
+		if len(parts) != 3 {
+			continue
+		}
+		ifIndex, _ := strconv.Atoi(parts[0])
+		nbrRouterID, _ := strconv.ParseUint(parts[2], 10, 32)
+		state := int32(gosnmp.ToBigInt(val.Value).Int64())
+
+		address := ""
+		if bytes, ok := addresses[index].Value.([]byte); ok && len(bytes) == net.IPv6len {
+			address = net.IP(bytes).String()
+		}
+		neighbours = append(neighbours, models.OspfNeighbour{
+			Version:           3,
+			RouterID:          routerID,
+			NeighbourRouterID: uint32ToIP(nbrRouterID),
+			NeighbourAddress:  address,
+			IfIndex:           int32(ifIndex),
+			AreaID:            uint32ToIP(areas[parts[0]+"."+parts[1]].Value),
+			State:             state,
+			StateName:         OspfNbrStates[state],
+		})
+	}
+	return neighbours, nil
+}
+
+// uint32ToIP formats OSPFv3 router and area ids as dotted quads like
+// OSPFv2 ones.
+func uint32ToIP(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, uint32(gosnmp.ToBigInt(value).Uint64()))
+	return ip.String()
+}
+
+// ipValue returns an IpAddress value, gosnmp decodes them as strings.
+func ipValue(val gosnmp.SnmpPDU) string {
+	ip, ok := val.Value.(string)
+	if !ok {
+		return ""
+	}
+	return ip
+}
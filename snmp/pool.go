@@ -0,0 +1,190 @@
+package snmp
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"go.uber.org/zap"
+)
+
+var ErrBadDevice = errors.New("device has bad snmp configuration")
+
+type session struct {
+	client      *Client
+	credentials [sha256.Size]byte
+}
+
+// Pool keeps snmp sessions per device between poll cycles, so sockets and
+// v3 USM state (engine id, boots, keys) are not renegotiated every interval.
+// A session is replaced when device credentials change in the devices source.
+type Pool struct {
+	logger   *zap.Logger
+	settings *Settings
+
+	lock     sync.Mutex
+	sessions map[int32]*session
+}
+
+func NewPool(logger *zap.Logger, settings *Settings) *Pool {
+	return &Pool{
+		logger:   logger,
+		settings: settings,
+		sessions: map[int32]*session{},
+	}
+}
+
+// Get returns a connected client for the device, the same client is returned
+// for every collector of the device until credentials change. Clients lock
+// themselves for a whole walk, so they are never used under the pool lock.
+// Rate limiter waits of the poll end when ctx is done.
+func (p *Pool) Get(ctx context.Context, device *models.Device) (*Client, error) {
+	credentials := credentialsHash(device)
+	if p.settings != nil && p.settings.Rtt != nil {
+		p.settings.Rtt.ResetTimeouts(device.DeviceID)
+	}
+
+	s, stale, err := p.session(device, credentials)
+	if stale != nil {
+		p.closeSession(device.DeviceID, stale)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.client.setDevice(ctx, device)
+	return s.client, s.client.connect()
+}
+
+// session returns the device session, a session with other credentials is
+// replaced and returned as stale to be closed.
+func (p *Pool) session(device *models.Device, credentials [sha256.Size]byte) (*session, *session, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	s, ok := p.sessions[device.DeviceID]
+	if ok && s.credentials == credentials {
+		return s, nil, nil
+	}
+	var stale *session
+	if ok {
+		p.logger.Info("device credentials changed, new snmp session", zap.Int32("device_id", device.DeviceID))
+		delete(p.sessions, device.DeviceID)
+		stale = s
+	}
+
+	client, err := New(device, p.logger, p.settings)
+	if err != nil {
+		return nil, stale, err
+	}
+	s = &session{
+		client:      client,
+		credentials: credentials,
+	}
+	p.sessions[device.DeviceID] = s
+	return s, stale, nil
+}
+
+// Invalidate closes a device session, next Get creates a new one.
+func (p *Pool) Invalidate(deviceID int32) {
+	p.lock.Lock()
+	s, ok := p.sessions[deviceID]
+	delete(p.sessions, deviceID)
+	p.lock.Unlock()
+	if ok {
+		p.closeSession(deviceID, s)
+	}
+}
+
+// Retain closes sessions and forgets rate limits of devices which are not in
+// the list anymore.
+func (p *Pool) Retain(devices []models.Device) {
+	keep := make(map[int32]struct{}, len(devices))
+	for _, dev := range devices {
+		keep[dev.DeviceID] = struct{}{}
+	}
+
+	if p.settings != nil && p.settings.Limiter != nil {
+		p.settings.Limiter.Retain(devices)
+	}
+
+	p.lock.Lock()
+	removed := map[int32]*session{}
+	for deviceID, s := range p.sessions {
+		if _, ok := keep[deviceID]; !ok {
+			removed[deviceID] = s
+			delete(p.sessions, deviceID)
+		}
+	}
+	p.lock.Unlock()
+	for deviceID, s := range removed {
+		p.closeSession(deviceID, s)
+	}
+}
+
+// Close closes all sessions.
+func (p *Pool) Close() {
+	p.lock.Lock()
+	sessions := p.sessions
+	p.sessions = map[int32]*session{}
+	p.lock.Unlock()
+	for deviceID, s := range sessions {
+		p.closeSession(deviceID, s)
+	}
+}
+
+// Rtt returns response time statistics of a device.
+func (p *Pool) Rtt(deviceID int32) (RttStats, bool) {
+	if p.settings == nil || p.settings.Rtt == nil {
+		return RttStats{}, false
+	}
+	return p.settings.Rtt.Get(deviceID)
+}
+
+// RateLimitStats returns rate limiter totals, false without a limiter.
+func (p *Pool) RateLimitStats() (RateLimitStats, bool) {
+	if p.settings == nil || p.settings.Limiter == nil {
+		return RateLimitStats{}, false
+	}
+	return p.settings.Limiter.Stats(), true
+}
+
+// closeSession closes a session already removed from the pool, it waits for
+// a walk in progress.
+func (p *Pool) closeSession(deviceID int32, s *session) {
+	if err := s.client.Close(); err != nil {
+		p.logger.Debug("error close snmp session", zap.Int32("device_id", deviceID), zap.Error(err))
+	}
+}
+
+func (c *Client) setDevice(ctx context.Context, device *models.Device) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.device = device
+	c.ctx = ctx
+}
+
+func credentialsHash(device *models.Device) [sha256.Size]byte {
+	return sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%s|%s|%s|%s|%s|%s|%s|%s",
+		strValue(device.Hostname),
+		strValue(device.Transport),
+		device.Port,
+		strValue(device.SnmpVer),
+		strValue(device.Community),
+		strValue(device.AuthLevel),
+		strValue(device.AuthName),
+		strValue(device.AuthPass),
+		strValue(device.AuthAlgo),
+		strValue(device.CryptoPass),
+		strValue(device.CryptoAlgo),
+	)))
+}
+
+func strValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,238 @@
+package snmp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"go.uber.org/zap"
+)
+
+var ErrDeviceUnresponsive = errors.New("device did not respond to consecutive requests, skipping remaining walks")
+
+const (
+	// minimum samples before the estimate replaces the default timeout
+	rttMinSamples = 3
+	// gains from RFC 6298
+	rttAlpha = 0.125
+	rttBeta  = 0.25
+)
+
+// RttStats are smoothed response time statistics of a device.
+type RttStats struct {
+	Srtt                time.Duration
+	RttVar              time.Duration
+	Last                time.Duration
+	Samples             int64
+	Timeouts            int64
+	ConsecutiveTimeouts int
+}
+
+// RttTracker keeps response time statistics per device, it is shared by
+// all clients and survives session recreation.
+type RttTracker struct {
+	lock  sync.Mutex
+	stats map[int32]*RttStats
+}
+
+func NewRttTracker() *RttTracker {
+	return &RttTracker{
+		stats: map[int32]*RttStats{},
+	}
+}
+
+func (r *RttTracker) Get(deviceID int32) (RttStats, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	stats, ok := r.stats[deviceID]
+	if !ok {
+		return RttStats{}, false
+	}
+	return *stats, true
+}
+
+// Sample adds a response time of a request which was not retried, Karn's
+// algorithm, as we can't tell which of the retries was answered.
+func (r *RttTracker) Sample(deviceID int32, rtt time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	stats := r.get(deviceID)
+	stats.Last = rtt
+	stats.ConsecutiveTimeouts = 0
+	if stats.Samples == 0 {
+		stats.Srtt = rtt
+		stats.RttVar = rtt / 2
+	} else {
+		diff := stats.Srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		stats.RttVar = time.Duration((1-rttBeta)*float64(stats.RttVar) + rttBeta*float64(diff))
+		stats.Srtt = time.Duration((1-rttAlpha)*float64(stats.Srtt) + rttAlpha*float64(rtt))
+	}
+	stats.Samples++
+}
+
+// Timeout records a request which was not answered after all retries and
+// returns the number of consecutive timeouts.
+func (r *RttTracker) Timeout(deviceID int32) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	stats := r.get(deviceID)
+	stats.Timeouts++
+	stats.ConsecutiveTimeouts++
+	return stats.ConsecutiveTimeouts
+}
+
+// ResetTimeouts clears consecutive timeouts, so a device is tried again on
+// the next poll.
+func (r *RttTracker) ResetTimeouts(deviceID int32) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if stats, ok := r.stats[deviceID]; ok {
+		stats.ConsecutiveTimeouts = 0
+	}
+}
+
+func (r *RttTracker) get(deviceID int32) *RttStats {
+	stats, ok := r.stats[deviceID]
+	if !ok {
+		stats = &RttStats{}
+		r.stats[deviceID] = stats
+	}
+	return stats
+}
+
+// timeout returns a per request timeout of the device: configured override,
+// or srtt + 4 * rttvar within the configured bounds, or the default timeout
+// until we have enough samples.
+func (s *Settings) timeout(deviceID int32) time.Duration {
+	if s == nil {
+		return defaultTimeout
+	}
+	if timeout, ok := s.Timeouts[deviceID]; ok {
+		return timeout
+	}
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	if s.Rtt == nil {
+		return timeout
+	}
+	stats, ok := s.Rtt.Get(deviceID)
+	if !ok || stats.Samples < rttMinSamples {
+		return timeout
+	}
+
+	timeout = stats.Srtt + 4*stats.RttVar
+	if s.MinTimeout > 0 && timeout < s.MinTimeout {
+		timeout = s.MinTimeout
+	}
+	if s.MaxTimeout > 0 && timeout > s.MaxTimeout {
+		timeout = s.MaxTimeout
+	}
+	return timeout
+}
+
+// retries are taken as they are, 0 is no retries, the default is set by
+// config.
+func (s *Settings) retries() int {
+	if s == nil {
+		return defaultRetries
+	}
+	return s.Retries
+}
+
+// trackRtt hooks gosnmp request callbacks to measure response times.
+func (c *Client) trackRtt() {
+	if c.settings == nil || c.settings.Rtt == nil {
+		return
+	}
+	var sent time.Time
+	retried := false
+	c.client.OnSent = func(*gosnmp.GoSNMP) {
+		sent = time.Now()
+	}
+	c.client.OnRetry = func(*gosnmp.GoSNMP) {
+		retried = true
+	}
+	c.client.OnRecv = func(*gosnmp.GoSNMP) {
+		if !retried {
+			c.settings.Rtt.Sample(c.device.DeviceID, time.Since(sent))
+		}
+	}
+	c.client.OnFinish = func(*gosnmp.GoSNMP) {
+		retried = false
+	}
+	c.resetRetried = func() {
+		retried = false
+	}
+}
+
+// beforeWalk sets the adaptive timeout and refuses to walk a device which
+// stopped answering during this poll.
+func (c *Client) beforeWalk() error {
+	if c.resetRetried != nil {
+		c.resetRetried()
+	}
+	c.client.Timeout = c.settings.timeout(c.device.DeviceID)
+	c.client.Retries = c.settings.retries()
+
+	if c.settings == nil || c.settings.Rtt == nil || c.settings.MaxConsecutiveTimeouts == 0 {
+		return nil
+	}
+	stats, _ := c.settings.Rtt.Get(c.device.DeviceID)
+	if stats.ConsecutiveTimeouts >= c.settings.MaxConsecutiveTimeouts {
+		return ErrDeviceUnresponsive
+	}
+	return nil
+}
+
+// afterWalkError counts timeouts, other errors mean the agent answered.
+func (c *Client) afterWalkError(err error) {
+	if c.settings == nil || c.settings.Rtt == nil || !IsTimeout(err) {
+		return
+	}
+	count := c.settings.Rtt.Timeout(c.device.DeviceID)
+	c.logger.Debug("snmp request timed out", zap.Int32("device_id", c.device.DeviceID), zap.Int("consecutive_timeouts", count))
+}
+
+// IsTimeout tells if an error is a request timeout.
+func IsTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrDeviceUnresponsive) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// timeoutError is a request which got no response after the last retry.
+type timeoutError struct {
+	err error
+}
+
+func (e *timeoutError) Error() string   { return e.err.Error() }
+func (e *timeoutError) Unwrap() error   { return e.err }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// requestError types gosnmp errors of a request. After the last retry
+// gosnmp replaces the timeout net.Error with an untyped "request timeout"
+// error, this is the only place its message is matched.
+func requestError(err error) error {
+	if err == nil || IsTimeout(err) {
+		return err
+	}
+	if strings.HasPrefix(err.Error(), "request timeout") {
+		return &timeoutError{err: err}
+	}
+	return err
+}
@@ -10,6 +10,10 @@ import (
 )
 
 func setDeviceDataForInterfaces(metricsMap *models.SnmpInterfaceMetrics, device *models.Device) {
+	if device != nil {
+		metricsMap.DeviceID = device.DeviceID
+		metricsMap.PollerGroup = device.PollerGroup
+	}
 	if device != nil && device.Hostname != nil {
 		metricsMap.Hostname = *device.Hostname
 	}
@@ -0,0 +1,186 @@
+package avail_chouse
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/logingood/yt-snmp-go-poller/config"
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/storer"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+type ClickhouseClient struct {
+	dbName            string
+	availabilityTable string
+	eventsTable       string
+	conn              driver.Conn
+	logger            *zap.Logger
+
+	queue           chan *models.DeviceAvailability
+	shutdownTimeout time.Duration
+	lost            atomic.Int64
+}
+
+func New(logger *zap.Logger, conn driver.Conn, cfg *config.FromEnv) *ClickhouseClient {
+	return &ClickhouseClient{
+		logger:            logger,
+		conn:              conn,
+		dbName:            cfg.ClickhouseDb,
+		availabilityTable: cfg.ClickhouseAvailabilityTableName,
+		eventsTable:       cfg.ClickhouseDeviceEventsTableName,
+
+		queue:           make(chan *models.DeviceAvailability, cfg.ClickhouseQueueLength),
+		shutdownTimeout: cfg.ShutdownTimeout,
+	}
+}
+
+// Write enqueues a sample, it never blocks polling, when the queue is full
+// the sample is dropped and logged.
+func (c *ClickhouseClient) Write(sample *models.DeviceAvailability) {
+	select {
+	case c.queue <- sample:
+	default:
+		c.lost.Add(1)
+		c.logger.Error("availability queue is full, dropping sample", zap.Int32("device_id", sample.DeviceID))
+	}
+}
+
+// StartQueue starts a single writer which inserts everything queued since
+// the previous insert in one batch. When ctx is cancelled samples still
+// queued are flushed within the shutdown timeout.
+func (c *ClickhouseClient) StartQueue(ctx context.Context, errGroup *errgroup.Group) {
+	errGroup.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				c.logger.Info("availability clickhouse writer is shutting down", zap.Int("queued", len(c.queue)))
+				fctx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
+				defer cancel()
+				c.flush(fctx, nil)
+				return nil
+			case sample := <-c.queue:
+				c.flush(ctx, []*models.DeviceAvailability{sample})
+			}
+		}
+	})
+}
+
+// Pending returns how many samples are queued but not inserted yet.
+func (c *ClickhouseClient) Pending() int {
+	return len(c.queue)
+}
+
+// Lost returns how many samples were dropped or failed to be inserted.
+func (c *ClickhouseClient) Lost() int64 {
+	return c.lost.Load()
+}
+
+func (c *ClickhouseClient) flush(ctx context.Context, samples []*models.DeviceAvailability) {
+	for len(c.queue) > 0 {
+		samples = append(samples, <-c.queue)
+	}
+	if len(samples) == 0 {
+		return
+	}
+	if err := c.InsertAvailability(ctx, samples); err != nil {
+		c.lost.Add(int64(len(samples)))
+		c.logger.Error("error insert availability", zap.Error(err), zap.Int("samples", len(samples)))
+	}
+}
+
+func (c *ClickhouseClient) InsertAvailability(ctx context.Context, samples []*models.DeviceAvailability) error {
+	batch, err := c.conn.PrepareBatch(ctx, fmt.Sprintf("INSERT INTO %s.%s", c.dbName, c.availabilityTable))
+	if err != nil {
+		return err
+	}
+	for _, sample := range samples {
+		if err := batch.AppendStruct(sample); err != nil {
+			return err
+		}
+	}
+	return batch.Send()
+}
+
+func (c *ClickhouseClient) InsertEvents(ctx context.Context, events []*models.DeviceEvent) error {
+	batch, err := c.conn.PrepareBatch(ctx, fmt.Sprintf("INSERT INTO %s.%s", c.dbName, c.eventsTable))
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if err := batch.AppendStruct(event); err != nil {
+			return err
+		}
+	}
+	return batch.Send()
+}
+
+// Availability returns availability of a device over the last window.
+func (c *ClickhouseClient) Availability(ctx context.Context, deviceID int32, window time.Duration) (*models.AvailabilitySummary, error) {
+	var summary models.AvailabilitySummary
+	row := c.conn.QueryRow(ctx, fmt.Sprintf(`
+	SELECT
+		device_id,
+		count() AS polls,
+		countIf(reachable) AS reachable_polls,
+		100 * reachable_polls / polls AS availability_pct,
+		avgIf(response_time_ms, reachable) AS avg_response_time_ms
+	FROM %s.%s
+	WHERE device_id = ? AND time >= ?
+	GROUP BY device_id`, c.dbName, c.availabilityTable),
+		deviceID, time.Now().Add(-window).UTC().Unix(),
+	)
+	if err := row.ScanStruct(&summary); err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+func (c *ClickhouseClient) InitDb(ctx context.Context) error {
+	c.logger.Debug("create db", zap.String("db_name", c.dbName), zap.String("table_name", c.availabilityTable))
+	stm := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s.%s (
+		time Int64,
+		device_id Int32,
+		poller_group Int32,
+		hostname VARCHAR(255),
+		sys_name VARCHAR(255),
+		reachable Bool,
+		response_time_ms Float64,
+		error_class VARCHAR(32),
+		error VARCHAR(255)
+	)
+	ENGINE = MergeTree
+	ORDER BY (device_id, time)`,
+		c.dbName, c.availabilityTable)
+	if err := c.conn.Exec(ctx, stm); err != nil {
+		return err
+	}
+	if err := storer.AddColumn(ctx, c.conn, c.dbName, c.availabilityTable, "poller_group Int32 AFTER device_id"); err != nil {
+		return err
+	}
+
+	c.logger.Debug("create db", zap.String("db_name", c.dbName), zap.String("table_name", c.eventsTable))
+	stm = fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s.%s (
+		time Int64,
+		device_id Int32,
+		poller_group Int32,
+		hostname VARCHAR(255),
+		sys_name VARCHAR(255),
+		event VARCHAR(16),
+		error_class VARCHAR(32),
+		duration_seconds Int64
+	)
+	ENGINE = MergeTree
+	ORDER BY (device_id, time)`,
+		c.dbName, c.eventsTable)
+	if err := c.conn.Exec(ctx, stm); err != nil {
+		return err
+	}
+	return storer.AddColumn(ctx, c.conn, c.dbName, c.eventsTable, "poller_group Int32 AFTER device_id")
+}
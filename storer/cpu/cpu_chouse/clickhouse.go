@@ -0,0 +1,96 @@
+package cpu_chouse
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/logingood/yt-snmp-go-poller/config"
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/storer"
+	"go.uber.org/zap"
+)
+
+type ClickhouseClient struct {
+	dbName    string
+	tableName string
+	conn      driver.Conn
+	logger    *zap.Logger
+}
+
+func New(logger *zap.Logger, conn driver.Conn, cfg *config.FromEnv) *ClickhouseClient {
+	return &ClickhouseClient{
+		logger:    logger,
+		conn:      conn,
+		dbName:    cfg.ClickhouseDb,
+		tableName: cfg.ClickhouseCpuTableName,
+	}
+}
+
+// Insert writes a row per processor of every device.
+func (c *ClickhouseClient) Insert(metrics []*models.SnmpInterfaceMetrics) error {
+	batch, err := c.conn.PrepareBatch(context.Background(), fmt.Sprintf("INSERT INTO %s.%s", c.dbName, c.tableName))
+	if err != nil {
+		return err
+	}
+
+	rows := 0
+	for _, metric := range metrics {
+		for _, processor := range metric.Processors {
+			err := batch.Append(
+				metric.Time,
+				metric.DeviceID,
+				metric.SysName,
+				metric.Hostname,
+				metric.Hardware,
+				metric.OS,
+				metric.Location,
+
+				processor.Index,
+				processor.Descr,
+				processor.Load,
+				processor.Source,
+				metric.PollerGroup,
+			)
+			if err != nil {
+				return err
+			}
+			rows++
+		}
+	}
+	if rows == 0 {
+		return batch.Abort()
+	}
+	if err := batch.Send(); err != nil {
+		return err
+	}
+	c.logger.Debug("flushed cpu successfully", zap.Int("processors", rows))
+	return nil
+}
+
+func (c *ClickhouseClient) InitDb(ctx context.Context) error {
+	c.logger.Debug("create db", zap.String("db_name", c.dbName), zap.String("table_name", c.tableName))
+	stm := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s.%s (
+		time Int64,
+		device_id Int32,
+		sys_name VARCHAR(255),
+		hostname VARCHAR(255),
+		hardware VARCHAR(255),
+		os VARCHAR(255),
+		location VARCHAR(255),
+		index VARCHAR(64),
+		descr VARCHAR(255),
+		load Int64,
+		source VARCHAR(64),
+		poller_group Int32
+	)
+	ENGINE = MergeTree
+	ORDER BY (device_id, time)`,
+		c.dbName, c.tableName)
+	if err := c.conn.Exec(ctx, stm); err != nil {
+		return err
+	}
+	// rows are appended by position, so the column goes to the end
+	return storer.AddColumn(ctx, c.conn, c.dbName, c.tableName, "poller_group Int32")
+}
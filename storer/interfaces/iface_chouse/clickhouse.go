@@ -6,11 +6,15 @@ import (
 	"math/big"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/logingood/yt-snmp-go-poller/config"
 	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/rates"
 	"github.com/logingood/yt-snmp-go-poller/snmp"
+	"github.com/logingood/yt-snmp-go-poller/storer"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
@@ -18,10 +22,16 @@ import (
 type ClickhouseClient struct {
 	dbName         string
 	tableName      string
+	eventsTable    string
 	flushBatchSize int
 	conn           driver.Conn
 	queue          chan *models.SnmpInterfaceMetrics
 	logger         *zap.Logger
+
+	// Close waits for writes in progress before it closes the queue
+	lock   sync.RWMutex
+	closed bool
+	lost   atomic.Int64
 }
 
 func New(logger *zap.Logger, conn driver.Conn, cfg *config.FromEnv,
@@ -32,14 +42,23 @@ func New(logger *zap.Logger, conn driver.Conn, cfg *config.FromEnv,
 		queue:          make(chan *models.SnmpInterfaceMetrics, cfg.ClickhouseQueueLength),
 		dbName:         cfg.ClickhouseDb,
 		tableName:      cfg.ClickhouseInterfacesTableName,
+		eventsTable:    cfg.ClickhouseInterfaceEventsTableName,
 		flushBatchSize: cfg.ClickhouseFlushFrequency,
 	}
 }
 
-func (c *ClickhouseClient) Write(metric *models.SnmpInterfaceMetrics) {
+// Write enqueues a metric, it blocks while the queue is full and fails once
+// the storer is closed.
+func (c *ClickhouseClient) Write(metric *models.SnmpInterfaceMetrics) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.closed {
+		c.lost.Add(1)
+		return fmt.Errorf("interfaces storer is closed")
+	}
 	c.logger.Info("enqueue metric to writ to clickhouse", zap.Any("hostname", metric.Hostname), zap.Any("device", metric.SysName))
 	c.enqueue(metric)
-	return
+	return nil
 }
 
 func (c *ClickhouseClient) enqueue(flow *models.SnmpInterfaceMetrics) {
@@ -72,20 +91,37 @@ func (c *ClickhouseClient) StartQueue(ctx context.Context, errGroup *errgroup.Gr
 	return nil
 }
 
+// worker inserts a queued metric, metrics queued before Close are inserted
+// even when ctx is cancelled so nothing is lost on shutdown.
 func (c *ClickhouseClient) worker(ctx context.Context, job *models.SnmpInterfaceMetrics) error {
-	c.logger.Info("starting a clickhouse insert worker")
-	select {
-	case <-ctx.Done():
-		c.logger.Info("clickhouse worker is shutting down")
-		return nil
-	default:
-		c.logger.Info("clickhouse insert received a job to process", zap.Any("device", job.Hostname))
-		c.Insert([]*models.SnmpInterfaceMetrics{job})
-		if ctx.Err() != nil {
-			return ctx.Err()
-		}
-		return nil
+	c.logger.Info("clickhouse insert received a job to process", zap.Any("device", job.Hostname))
+	if err := c.Insert([]*models.SnmpInterfaceMetrics{job}); err != nil {
+		c.lost.Add(1)
+		c.logger.Error("error insert metric", zap.Error(err), zap.Any("device", job.Hostname))
+	}
+	return nil
+}
+
+// Close stops accepting metrics, queue workers return once the queue is
+// drained.
+func (c *ClickhouseClient) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
 	}
+	c.closed = true
+	close(c.queue)
+}
+
+// Pending returns how many metrics are queued but not inserted yet.
+func (c *ClickhouseClient) Pending() int {
+	return len(c.queue)
+}
+
+// Lost returns how many metrics failed to be inserted or came after Close.
+func (c *ClickhouseClient) Lost() int64 {
+	return c.lost.Load()
 }
 
 func (c *ClickhouseClient) Insert(metrics []*models.SnmpInterfaceMetrics) error {
@@ -109,7 +145,7 @@ func (c *ClickhouseClient) Insert(metrics []*models.SnmpInterfaceMetrics) error
 					counters.Counters[k] = bigInt
 				}
 			}
-			batch.Append(
+			values := []interface{}{
 				metric.Time,
 				metric.SysName,
 				metric.Hostname,
@@ -151,7 +187,19 @@ func (c *ClickhouseClient) Insert(metrics []*models.SnmpInterfaceMetrics) error
 				counters.Counters["ifInErrors"].Int64(),
 				counters.Counters["ifOutDiscards"].Int64(),
 				counters.Counters["ifOutErrors"].Int64(),
-			)
+
+				metric.RateInterval,
+			}
+			// rates are null until there are two valid samples
+			for _, def := range rates.RateDefinitions {
+				var rate *float64
+				if value, ok := counters.Rates[def.Name]; ok {
+					rate = &value
+				}
+				values = append(values, rate)
+			}
+			values = append(values, metric.PollerGroup)
+			batch.Append(values...)
 
 		}
 	}
@@ -162,6 +210,19 @@ func (c *ClickhouseClient) Insert(metrics []*models.SnmpInterfaceMetrics) error
 	return nil
 }
 
+func (c *ClickhouseClient) InsertEvents(events []*models.InterfaceEvent) error {
+	batch, err := c.conn.PrepareBatch(context.Background(), fmt.Sprintf("INSERT INTO %s.%s", c.dbName, c.eventsTable))
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if err := batch.AppendStruct(event); err != nil {
+			return err
+		}
+	}
+	return batch.Send()
+}
+
 func (c *ClickhouseClient) InitDb(ctx context.Context) error {
 	c.logger.Debug("create db", zap.String("db_name", c.dbName), zap.String("table_name", c.tableName))
 	stm := fmt.Sprintf(`
@@ -204,10 +265,48 @@ func (c *ClickhouseClient) InitDb(ctx context.Context) error {
 		if_in_discards Int64,
 		if_in_errors Int64,
 		if_out_discards Int64,
-		if_out_errors Int64
+		if_out_errors Int64,
+		rate_interval Float64
 	)
 	ENGINE = MergeTree
 	ORDER BY tuple()`,
 		c.dbName, c.tableName)
-	return c.conn.Exec(ctx, stm)
+	if err := c.conn.Exec(ctx, stm); err != nil {
+		return err
+	}
+
+	// rows are appended by position, columns added later go to the end in
+	// the order they are appended
+	columns := []string{"rate_interval Float64"}
+	for _, def := range rates.RateDefinitions {
+		columns = append(columns, def.Name+" Nullable(Float64)")
+	}
+	columns = append(columns, "poller_group Int32")
+	for _, column := range columns {
+		if err := storer.AddColumn(ctx, c.conn, c.dbName, c.tableName, column); err != nil {
+			return err
+		}
+	}
+
+	c.logger.Debug("create db", zap.String("db_name", c.dbName), zap.String("table_name", c.eventsTable))
+	stm = fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s.%s (
+		time Int64,
+		device_id Int32,
+		poller_group Int32,
+		hostname VARCHAR(255),
+		sys_name VARCHAR(255),
+		if_index Int32,
+		if_name VARCHAR(255),
+		event VARCHAR(32),
+		old_value VARCHAR(255),
+		new_value VARCHAR(255)
+	)
+	ENGINE = MergeTree
+	ORDER BY (device_id, time)`,
+		c.dbName, c.eventsTable)
+	if err := c.conn.Exec(ctx, stm); err != nil {
+		return err
+	}
+	return storer.AddColumn(ctx, c.conn, c.dbName, c.eventsTable, "poller_group Int32 AFTER device_id")
 }
@@ -0,0 +1,242 @@
+package jsonl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"go.uber.org/zap"
+)
+
+// Record types, every line is {"type": ..., "data": ...}.
+const (
+	TypeMetrics        = "metrics"
+	TypeInterfaceEvent = "interface_event"
+	TypeOspfEvent      = "ospf_event"
+	TypeAvailability   = "availability"
+	TypeDeviceEvent    = "device_event"
+	TypePollResult     = "poll"
+)
+
+const (
+	// sorts rotated files oldest first
+	rotatedTimeFormat = "20060102T150405.000"
+	fileMode          = 0o644
+)
+
+type record struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// Writer writes everything as JSON lines to stdout or a file. A file is
+// rotated when it would grow over maxSize or is older than maxAge, rotated
+// files get a timestamp suffix and only the newest backups are kept.
+type Writer struct {
+	logger  *zap.Logger
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	backups int
+
+	lock   sync.Mutex
+	out    io.Writer
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewStdout creates a writer to stdout, it is never rotated.
+func NewStdout(logger *zap.Logger) *Writer {
+	return &Writer{
+		logger: logger,
+		out:    os.Stdout,
+	}
+}
+
+// NewFile creates a writer appending to path. maxSize in bytes and maxAge
+// of 0 disable rotation by size or age, 0 backups keeps all of them.
+func NewFile(logger *zap.Logger, path string, maxSize int64, maxAge time.Duration, backups int) (*Writer, error) {
+	if path == "" {
+		return nil, fmt.Errorf("jsonl storer needs a file path")
+	}
+	w := &Writer{
+		logger:  logger,
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		backups: backups,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) InsertMetrics(ctx context.Context, metrics []*models.SnmpInterfaceMetrics) error {
+	return write(w, TypeMetrics, metrics)
+}
+
+func (w *Writer) InsertInterfaceEvents(ctx context.Context, events []*models.InterfaceEvent) error {
+	return write(w, TypeInterfaceEvent, events)
+}
+
+func (w *Writer) InsertOspfEvents(ctx context.Context, events []*models.OspfNeighbourEvent) error {
+	return write(w, TypeOspfEvent, events)
+}
+
+func (w *Writer) InsertAvailability(ctx context.Context, samples []*models.DeviceAvailability) error {
+	return write(w, TypeAvailability, samples)
+}
+
+func (w *Writer) InsertDeviceEvents(ctx context.Context, events []*models.DeviceEvent) error {
+	return write(w, TypeDeviceEvent, events)
+}
+
+func (w *Writer) InsertPollResults(ctx context.Context, results []*models.PollResult) error {
+	return write(w, TypePollResult, results)
+}
+
+// Close closes the file, writes are not buffered.
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	w.out = nil
+	return err
+}
+
+// Pending is always 0, every batch is written before Insert returns.
+func (w *Writer) Pending() int {
+	return 0
+}
+
+// Lost is always 0, write errors are returned by Insert.
+func (w *Writer) Lost() int64 {
+	return 0
+}
+
+// write encodes a batch one record per line and writes it at once, so
+// lines of concurrent batches are not interleaved.
+func write[T any](w *Writer, recordType string, batch []T) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, item := range batch {
+		if err := enc.Encode(record{Type: recordType, Data: item}); err != nil {
+			return err
+		}
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.out == nil {
+		return os.ErrClosed
+	}
+	if err := w.rotate(int64(buf.Len()), time.Now()); err != nil {
+		return err
+	}
+	n, err := w.out.Write(buf.Bytes())
+	w.size += int64(n)
+	return err
+}
+
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, fileMode)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.out = file
+	w.size = info.Size()
+	// age rotation does not restart with the poller, an existing file was
+	// started at the last rotation or, if it was never rotated, we only
+	// know its last write
+	w.opened = time.Now()
+	if w.size > 0 {
+		w.opened = info.ModTime()
+		if rotated, ok := w.lastRotation(); ok && rotated.Before(w.opened) {
+			w.opened = rotated
+		}
+	}
+	return nil
+}
+
+// lastRotation returns the time of the newest rotated file.
+func (w *Writer) lastRotation() (time.Time, bool) {
+	rotated, err := filepath.Glob(w.path + ".*")
+	if err != nil || len(rotated) == 0 {
+		return time.Time{}, false
+	}
+	sort.Strings(rotated)
+	suffix := strings.TrimPrefix(rotated[len(rotated)-1], w.path+".")
+	last, err := time.Parse(rotatedTimeFormat, suffix)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return last, true
+}
+
+// rotate starts a new file if the next write would make the current one
+// too big or it is too old, an empty file is never rotated.
+func (w *Writer) rotate(next int64, now time.Time) error {
+	if w.file == nil || w.size == 0 {
+		return nil
+	}
+	tooBig := w.maxSize > 0 && w.size+next > w.maxSize
+	tooOld := w.maxAge > 0 && now.Sub(w.opened) >= w.maxAge
+	if !tooBig && !tooOld {
+		return nil
+	}
+
+	if err := w.file.Close(); err != nil {
+		w.logger.Warn("error close jsonl file", zap.Error(err), zap.String("path", w.path))
+	}
+	w.file, w.out = nil, nil
+	rotated := w.path + "." + now.UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(w.path, rotated); err != nil {
+		w.logger.Error("error rotate jsonl file, keep writing to it", zap.Error(err), zap.String("path", w.path))
+		return w.open()
+	}
+	w.logger.Info("rotated jsonl file", zap.String("path", rotated), zap.Int64("size", w.size))
+	w.prune()
+	return w.open()
+}
+
+// prune removes the oldest rotated files over the number of backups, the
+// timestamp suffix sorts them oldest first.
+func (w *Writer) prune() {
+	if w.backups <= 0 {
+		return
+	}
+	rotated, err := filepath.Glob(w.path + ".*")
+	if err != nil || len(rotated) <= w.backups {
+		return
+	}
+	sort.Strings(rotated)
+	for _, path := range rotated[:len(rotated)-w.backups] {
+		if err := os.Remove(path); err != nil {
+			w.logger.Warn("error remove rotated jsonl file", zap.Error(err), zap.String("path", path))
+		}
+	}
+}
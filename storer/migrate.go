@@ -0,0 +1,14 @@
+package storer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// AddColumn adds a column to a table created by an older version, column
+// is a definition like "poller_group Int32 AFTER device_id".
+func AddColumn(ctx context.Context, conn driver.Conn, db, table, column string) error {
+	return conn.Exec(ctx, fmt.Sprintf("ALTER TABLE %s.%s ADD COLUMN IF NOT EXISTS %s", db, table, column))
+}
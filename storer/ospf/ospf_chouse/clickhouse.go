@@ -0,0 +1,121 @@
+package ospf_chouse
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/logingood/yt-snmp-go-poller/config"
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/storer"
+	"go.uber.org/zap"
+)
+
+type ClickhouseClient struct {
+	dbName          string
+	neighboursTable string
+	eventsTable     string
+	conn            driver.Conn
+	logger          *zap.Logger
+}
+
+func New(logger *zap.Logger, conn driver.Conn, cfg *config.FromEnv) *ClickhouseClient {
+	return &ClickhouseClient{
+		logger:          logger,
+		conn:            conn,
+		dbName:          cfg.ClickhouseDb,
+		neighboursTable: cfg.ClickhouseOspfNeighboursTableName,
+		eventsTable:     cfg.ClickhouseOspfEventsTableName,
+	}
+}
+
+// Insert writes a row per neighbour of every device.
+func (c *ClickhouseClient) Insert(metrics []*models.SnmpInterfaceMetrics) error {
+	batch, err := c.conn.PrepareBatch(context.Background(), fmt.Sprintf("INSERT INTO %s.%s", c.dbName, c.neighboursTable))
+	if err != nil {
+		return err
+	}
+
+	rows := 0
+	for _, metric := range metrics {
+		for i := range metric.Ospf {
+			if err := batch.AppendStruct(&metric.Ospf[i]); err != nil {
+				return err
+			}
+			rows++
+		}
+	}
+	if rows == 0 {
+		return batch.Abort()
+	}
+	if err := batch.Send(); err != nil {
+		return err
+	}
+	c.logger.Debug("flushed ospf neighbours successfully", zap.Int("neighbours", rows))
+	return nil
+}
+
+func (c *ClickhouseClient) InsertEvents(events []*models.OspfNeighbourEvent) error {
+	batch, err := c.conn.PrepareBatch(context.Background(), fmt.Sprintf("INSERT INTO %s.%s", c.dbName, c.eventsTable))
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if err := batch.AppendStruct(event); err != nil {
+			return err
+		}
+	}
+	return batch.Send()
+}
+
+func (c *ClickhouseClient) InitDb(ctx context.Context) error {
+	c.logger.Debug("create db", zap.String("db_name", c.dbName), zap.String("table_name", c.neighboursTable))
+	stm := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s.%s (
+		time Int64,
+		device_id Int32,
+		poller_group Int32,
+		hostname VARCHAR(255),
+		sys_name VARCHAR(255),
+		version Int32,
+		router_id VARCHAR(64),
+		neighbour_router_id VARCHAR(64),
+		neighbour_address VARCHAR(64),
+		if_index Int32,
+		area_id VARCHAR(64),
+		state Int32,
+		state_name VARCHAR(32)
+	)
+	ENGINE = MergeTree
+	ORDER BY (device_id, time)`,
+		c.dbName, c.neighboursTable)
+	if err := c.conn.Exec(ctx, stm); err != nil {
+		return err
+	}
+	if err := storer.AddColumn(ctx, c.conn, c.dbName, c.neighboursTable, "poller_group Int32 AFTER device_id"); err != nil {
+		return err
+	}
+
+	c.logger.Debug("create db", zap.String("db_name", c.dbName), zap.String("table_name", c.eventsTable))
+	stm = fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s.%s (
+		time Int64,
+		device_id Int32,
+		poller_group Int32,
+		hostname VARCHAR(255),
+		sys_name VARCHAR(255),
+		version Int32,
+		neighbour_router_id VARCHAR(64),
+		neighbour_address VARCHAR(64),
+		area_id VARCHAR(64),
+		old_state VARCHAR(32),
+		new_state VARCHAR(32)
+	)
+	ENGINE = MergeTree
+	ORDER BY (device_id, time)`,
+		c.dbName, c.eventsTable)
+	if err := c.conn.Exec(ctx, stm); err != nil {
+		return err
+	}
+	return storer.AddColumn(ctx, c.conn, c.dbName, c.eventsTable, "poller_group Int32 AFTER device_id")
+}
@@ -0,0 +1,72 @@
+package poll_chouse
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/logingood/yt-snmp-go-poller/config"
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/storer"
+	"go.uber.org/zap"
+)
+
+type ClickhouseClient struct {
+	dbName    string
+	tableName string
+	conn      driver.Conn
+	logger    *zap.Logger
+}
+
+func New(logger *zap.Logger, conn driver.Conn, cfg *config.FromEnv) *ClickhouseClient {
+	return &ClickhouseClient{
+		logger:    logger,
+		conn:      conn,
+		dbName:    cfg.ClickhouseDb,
+		tableName: cfg.ClickhousePollLogTableName,
+	}
+}
+
+func (c *ClickhouseClient) Insert(ctx context.Context, results []*models.PollResult) error {
+	batch, err := c.conn.PrepareBatch(ctx, fmt.Sprintf("INSERT INTO %s.%s", c.dbName, c.tableName))
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if err := batch.AppendStruct(result); err != nil {
+			return err
+		}
+	}
+	return batch.Send()
+}
+
+func (c *ClickhouseClient) InitDb(ctx context.Context) error {
+	c.logger.Debug("create db", zap.String("db_name", c.dbName), zap.String("table_name", c.tableName))
+	stm := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s.%s (
+		time Int64,
+		device_id Int32,
+		poller_group Int32,
+		hostname VARCHAR(255),
+		sys_name VARCHAR(255),
+		duration_ms Float64,
+		status VARCHAR(16),
+		error_class VARCHAR(32),
+		error String,
+		collector_status Map(String, String),
+		collector_duration_ms Map(String, Float64),
+		consecutive_failures Int32,
+		quarantined_until Int64,
+		rate_limit_wait_ms Float64
+	)
+	ENGINE = MergeTree
+	ORDER BY (device_id, time)`,
+		c.dbName, c.tableName)
+	if err := c.conn.Exec(ctx, stm); err != nil {
+		return err
+	}
+	if err := storer.AddColumn(ctx, c.conn, c.dbName, c.tableName, "poller_group Int32 AFTER device_id"); err != nil {
+		return err
+	}
+	return storer.AddColumn(ctx, c.conn, c.dbName, c.tableName, "rate_limit_wait_ms Float64")
+}
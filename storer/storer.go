@@ -1,9 +1,30 @@
 package storer
 
 import (
+	"context"
+
 	"github.com/logingood/yt-snmp-go-poller/models"
 )
 
 type Storer interface {
 	Write([]*models.SnmpInterfaceMetrics)
 }
+
+// Sink stores everything the poller produces, it is ClickHouse or JSON
+// lines.
+type Sink interface {
+	// InsertMetrics stores interfaces, cpu and ospf of a poll, collectors
+	// which did not run are not stored. Interfaces may be queued.
+	InsertMetrics(ctx context.Context, metrics []*models.SnmpInterfaceMetrics) error
+	InsertInterfaceEvents(ctx context.Context, events []*models.InterfaceEvent) error
+	InsertOspfEvents(ctx context.Context, events []*models.OspfNeighbourEvent) error
+	InsertAvailability(ctx context.Context, samples []*models.DeviceAvailability) error
+	InsertDeviceEvents(ctx context.Context, events []*models.DeviceEvent) error
+	InsertPollResults(ctx context.Context, results []*models.PollResult) error
+	// Close stops accepting data, queued data is still flushed
+	Close() error
+	// Pending returns how much data is queued but not flushed yet
+	Pending() int
+	// Lost returns how much queued data failed to be stored
+	Lost() int64
+}
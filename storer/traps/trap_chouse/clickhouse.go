@@ -0,0 +1,134 @@
+package trap_chouse
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/logingood/yt-snmp-go-poller/config"
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/storer"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+type ClickhouseClient struct {
+	dbName          string
+	tableName       string
+	conn            driver.Conn
+	queue           chan *models.Trap
+	logger          *zap.Logger
+	shutdownTimeout time.Duration
+	lost            atomic.Int64
+}
+
+func New(logger *zap.Logger, conn driver.Conn, cfg *config.TrapFromEnv) *ClickhouseClient {
+	return &ClickhouseClient{
+		logger:    logger,
+		conn:      conn,
+		queue:     make(chan *models.Trap, cfg.TrapsQueueLength),
+		dbName:    cfg.ClickhouseDb,
+		tableName: cfg.ClickhouseTrapsTableName,
+
+		shutdownTimeout: cfg.ShutdownTimeout,
+	}
+}
+
+// Write enqueues a trap, it never blocks the trap listener, when the queue
+// is full the trap is dropped and logged.
+func (c *ClickhouseClient) Write(trap *models.Trap) {
+	select {
+	case c.queue <- trap:
+	default:
+		c.logger.Error("traps queue is full, dropping trap", zap.String("source", trap.SourceAddr), zap.String("trap_oid", trap.TrapOid))
+	}
+}
+
+// StartQueue starts a single writer which inserts everything queued since
+// the previous insert in one batch. When ctx is cancelled traps still queued
+// are flushed within the shutdown timeout.
+func (c *ClickhouseClient) StartQueue(ctx context.Context, errGroup *errgroup.Group) {
+	errGroup.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				c.logger.Info("traps clickhouse writer is shutting down", zap.Int("queued", len(c.queue)))
+				fctx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
+				defer cancel()
+				c.flush(fctx, nil)
+				return nil
+			case trap := <-c.queue:
+				c.flush(ctx, []*models.Trap{trap})
+			}
+		}
+	})
+}
+
+// Lost returns how many traps failed to be inserted.
+func (c *ClickhouseClient) Lost() int64 {
+	return c.lost.Load()
+}
+
+func (c *ClickhouseClient) flush(ctx context.Context, traps []*models.Trap) {
+	for len(c.queue) > 0 {
+		traps = append(traps, <-c.queue)
+	}
+	if len(traps) == 0 {
+		return
+	}
+	if err := c.Insert(ctx, traps); err != nil {
+		c.lost.Add(int64(len(traps)))
+		c.logger.Error("error insert traps", zap.Error(err), zap.Int("traps", len(traps)))
+	}
+}
+
+func (c *ClickhouseClient) Insert(ctx context.Context, traps []*models.Trap) error {
+	batch, err := c.conn.PrepareBatch(ctx, fmt.Sprintf("INSERT INTO %s.%s", c.dbName, c.tableName))
+	if err != nil {
+		return err
+	}
+
+	for _, trap := range traps {
+		if err := batch.AppendStruct(trap); err != nil {
+			return err
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return err
+	}
+	c.logger.Debug("flushed traps successfully", zap.Int("traps", len(traps)))
+	return nil
+}
+
+func (c *ClickhouseClient) InitDb(ctx context.Context) error {
+	c.logger.Debug("create db", zap.String("db_name", c.dbName), zap.String("table_name", c.tableName))
+	stm := fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s.%s (
+		time Int64,
+		device_id Int32,
+		poller_group Int32,
+		hostname VARCHAR(255),
+		sys_name VARCHAR(255),
+		source_addr VARCHAR(255),
+		version VARCHAR(8),
+		pdu_type VARCHAR(16),
+		trap_oid VARCHAR(255),
+		trap_name VARCHAR(255),
+		if_index Int32,
+		if_name VARCHAR(255),
+		admin_status Int32,
+		oper_status Int32,
+		bgp_peer VARCHAR(255),
+		bgp_peer_state Int32,
+		varbinds Map(String, String)
+	)
+	ENGINE = MergeTree
+	ORDER BY (device_id, time)`,
+		c.dbName, c.tableName)
+	if err := c.conn.Exec(ctx, stm); err != nil {
+		return err
+	}
+	return storer.AddColumn(ctx, c.conn, c.dbName, c.tableName, "poller_group Int32 AFTER device_id")
+}
@@ -0,0 +1,171 @@
+package trap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/snmp"
+)
+
+const (
+	snmpTrapOid     = ".1.3.6.1.6.3.1.1.4.1.0"
+	snmpTrapsPrefix = ".1.3.6.1.6.3.1.1.5"
+
+	bgpPeerState      = ".1.3.6.1.2.1.15.3.1.2"
+	bgpPeerRemoteAddr = ".1.3.6.1.2.1.15.3.1.7"
+	ifName            = ".1.3.6.1.2.1.31.1.1.1.1"
+)
+
+// WellKnownTraps maps trap OIDs we decode to their names. BGP4-MIB traps
+// have two registrations, RFC 1657 (bgpTraps.7) and RFC 4273 (bgp.0), agents
+// send either of them.
+var WellKnownTraps = map[string]string{
+	".1.3.6.1.6.3.1.1.5.1": "coldStart",
+	".1.3.6.1.6.3.1.1.5.2": "warmStart",
+	".1.3.6.1.6.3.1.1.5.3": "linkDown",
+	".1.3.6.1.6.3.1.1.5.4": "linkUp",
+	".1.3.6.1.6.3.1.1.5.5": "authenticationFailure",
+	".1.3.6.1.2.1.15.0.1":  "bgpEstablished",
+	".1.3.6.1.2.1.15.0.2":  "bgpBackwardTransition",
+	".1.3.6.1.2.1.15.7.1":  "bgpEstablished",
+	".1.3.6.1.2.1.15.7.2":  "bgpBackwardTransition",
+}
+
+// Decode converts a received packet to a trap model. v1 traps are converted
+// to v2 trap oids as described in RFC 3584 section 3.1, so linkDown is the
+// same regardless of the version the agent used.
+func Decode(packet *gosnmp.SnmpPacket, addr *net.UDPAddr) *models.Trap {
+	trap := &models.Trap{
+		Time:     time.Now().UTC().Unix(),
+		Version:  packet.Version.String(),
+		PduType:  "trap",
+		Varbinds: make(map[string]string, len(packet.Variables)),
+	}
+	if addr != nil {
+		trap.SourceAddr = addr.IP.String()
+	}
+	if packet.PDUType == gosnmp.InformRequest {
+		trap.PduType = "inform"
+	}
+
+	if packet.Version == gosnmp.Version1 {
+		trap.TrapOid = v1TrapOid(packet)
+	}
+
+	for _, val := range packet.Variables {
+		name := normaliseOid(val.Name)
+		value := printableValue(val)
+		trap.Varbinds[name] = value
+		if name == snmpTrapOid {
+			trap.TrapOid = normaliseOid(value)
+		}
+	}
+
+	trap.TrapName = WellKnownTraps[trap.TrapOid]
+	switch trap.TrapName {
+	case "linkUp", "linkDown":
+		decodeLink(trap, packet.Variables)
+	case "bgpEstablished", "bgpBackwardTransition":
+		decodeBgp(trap, packet.Variables)
+	}
+
+	return trap
+}
+
+// AgentAddress returns v1 agent-addr field if it is set, this is the
+// address of the device which may differ from the udp source when traps are
+// relayed or sent from a loopback.
+func AgentAddress(packet *gosnmp.SnmpPacket) string {
+	if packet.Version != gosnmp.Version1 || packet.AgentAddress == "" || packet.AgentAddress == "0.0.0.0" {
+		return ""
+	}
+	return packet.AgentAddress
+}
+
+func v1TrapOid(packet *gosnmp.SnmpPacket) string {
+	if packet.GenericTrap >= 0 && packet.GenericTrap < 6 {
+		return fmt.Sprintf("%s.%d", snmpTrapsPrefix, packet.GenericTrap+1)
+	}
+	// enterpriseSpecific
+	return fmt.Sprintf("%s.0.%d", normaliseOid(packet.Enterprise), packet.SpecificTrap)
+}
+
+// decodeLink sets interface fields of IF-MIB linkUp and linkDown, the
+// interface index is taken from any of the ifEntry varbinds.
+func decodeLink(trap *models.Trap, variables []gosnmp.SnmpPDU) {
+	for _, val := range variables {
+		name := normaliseOid(val.Name)
+		switch {
+		case strings.HasPrefix(name, snmp.StrNameToOidMap["ifIndex"]+"."):
+			trap.IfIndex = int32(gosnmp.ToBigInt(val.Value).Int64())
+		case strings.HasPrefix(name, snmp.StrNameToOidMap["ifAdminStatus"]+"."):
+			trap.IfIndex = oidIndex(name)
+			trap.AdminStatus = int32(gosnmp.ToBigInt(val.Value).Int64())
+		case strings.HasPrefix(name, snmp.StrNameToOidMap["ifOperStatus"]+"."):
+			trap.IfIndex = oidIndex(name)
+			trap.OperStatus = int32(gosnmp.ToBigInt(val.Value).Int64())
+		case strings.HasPrefix(name, snmp.StrNameToOidMap["ifDescr"]+"."):
+			if trap.IfName == "" {
+				trap.IfName = printableValue(val)
+			}
+		case strings.HasPrefix(name, ifName+"."):
+			trap.IfName = printableValue(val)
+		}
+	}
+}
+
+// decodeBgp sets peer fields of BGP4-MIB traps, peer is the index of
+// bgpPeerTable, which is the remote address.
+func decodeBgp(trap *models.Trap, variables []gosnmp.SnmpPDU) {
+	for _, val := range variables {
+		name := normaliseOid(val.Name)
+		switch {
+		case strings.HasPrefix(name, bgpPeerState+"."):
+			trap.BgpPeer = strings.TrimPrefix(name, bgpPeerState+".")
+			trap.BgpPeerState = int32(gosnmp.ToBigInt(val.Value).Int64())
+		case strings.HasPrefix(name, bgpPeerRemoteAddr+"."):
+			trap.BgpPeer = strings.TrimPrefix(name, bgpPeerRemoteAddr+".")
+		}
+	}
+}
+
+func oidIndex(oid string) int32 {
+	index, _ := strconv.Atoi(oid[strings.LastIndex(oid, ".")+1:])
+	return int32(index)
+}
+
+func normaliseOid(oid string) string {
+	if oid == "" || strings.HasPrefix(oid, ".") {
+		return oid
+	}
+	return "." + oid
+}
+
+func printableValue(val gosnmp.SnmpPDU) string {
+	switch val.Type {
+	case gosnmp.OctetString:
+		bytes, ok := val.Value.([]byte)
+		if !ok {
+			return fmt.Sprint(val.Value)
+		}
+		if utf8.Valid(bytes) && strings.IndexFunc(string(bytes), isControl) < 0 {
+			return string(bytes)
+		}
+		return hex.EncodeToString(bytes)
+	case gosnmp.ObjectIdentifier:
+		return normaliseOid(fmt.Sprint(val.Value))
+	default:
+		return fmt.Sprint(val.Value)
+	}
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 && r != '\n' && r != '\r' && r != '\t'
+}
@@ -0,0 +1,160 @@
+package trap
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/logingood/yt-snmp-go-poller/devices"
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"go.uber.org/zap"
+)
+
+// HandleFunc receives every decoded trap, it is called from the listener
+// loop so it must not block for long.
+type HandleFunc func(*models.Trap)
+
+// Receiver listens for traps and informs, matches their source to a
+// LibreNMS device and passes decoded traps to the handler. Informs are
+// acknowledged by gosnmp listener once the handler returns.
+type Receiver struct {
+	logger   *zap.Logger
+	devices  devices.Devices
+	listener *gosnmp.TrapListener
+	addr     string
+	refresh  time.Duration
+	handler  HandleFunc
+
+	lock   sync.RWMutex
+	byAddr map[string]models.Device
+}
+
+func New(logger *zap.Logger, devices devices.Devices, params *gosnmp.GoSNMP, addr string, refresh time.Duration, handler HandleFunc) *Receiver {
+	r := &Receiver{
+		logger:   logger,
+		devices:  devices,
+		listener: gosnmp.NewTrapListener(),
+		addr:     addr,
+		refresh:  refresh,
+		handler:  handler,
+		byAddr:   map[string]models.Device{},
+	}
+	r.listener.Params = params
+	r.listener.OnNewTrap = r.onTrap
+
+	return r
+}
+
+// Listen blocks until the context is cancelled or the listener fails.
+func (r *Receiver) Listen(ctx context.Context) error {
+	// unmatched traps are still stored, so a broken devices source should
+	// not stop us from receiving
+	if err := r.refreshDevices(ctx); err != nil {
+		r.logger.Error("error list devices for traps", zap.Error(err))
+	}
+	go r.refreshLoop(ctx)
+
+	go func() {
+		select {
+		case <-r.listener.Listening():
+		case <-ctx.Done():
+			return
+		}
+		<-ctx.Done()
+		r.logger.Info("stopping trap listener")
+		r.listener.Close()
+	}()
+
+	r.logger.Info("start trap listener", zap.String("addr", r.addr))
+	return r.listener.Listen(r.addr)
+}
+
+func (r *Receiver) onTrap(packet *gosnmp.SnmpPacket, addr *net.UDPAddr) {
+	trap := Decode(packet, addr)
+
+	dev, ok := r.lookup(AgentAddress(packet))
+	if !ok {
+		dev, ok = r.lookup(trap.SourceAddr)
+	}
+	if ok {
+		trap.DeviceID = dev.DeviceID
+		trap.PollerGroup = dev.PollerGroup
+		if dev.Hostname != nil {
+			trap.Hostname = *dev.Hostname
+		}
+		if dev.SysName != nil {
+			trap.SysName = *dev.SysName
+		}
+	} else {
+		r.logger.Debug("trap from unknown device", zap.String("source", trap.SourceAddr))
+	}
+
+	r.logger.Debug("received trap", zap.String("source", trap.SourceAddr), zap.String("trap_oid", trap.TrapOid), zap.String("trap_name", trap.TrapName))
+	r.handler(trap)
+}
+
+func (r *Receiver) lookup(addr string) (models.Device, bool) {
+	if addr == "" {
+		return models.Device{}, false
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	dev, ok := r.byAddr[strings.ToLower(addr)]
+	return dev, ok
+}
+
+func (r *Receiver) refreshLoop(ctx context.Context) {
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.refreshDevices(ctx); err != nil {
+				r.logger.Error("error refresh devices for traps, keep the previous list", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshDevices builds an address index of devices, LibreNMS hostname
+// is either an IP or a name which we resolve, traps come from IPs.
+func (r *Receiver) refreshDevices(ctx context.Context) error {
+	byAddr := map[string]models.Device{}
+	devs := 0
+	err := r.devices.EachDevice(ctx, func(dev models.Device) error {
+		devs++
+		if dev.Hostname == nil || *dev.Hostname == "" {
+			return nil
+		}
+		hostname := strings.ToLower(*dev.Hostname)
+		byAddr[hostname] = dev
+		if ip := net.ParseIP(hostname); ip != nil {
+			byAddr[ip.String()] = dev
+			return nil
+		}
+		addrs, err := net.DefaultResolver.LookupHost(ctx, hostname)
+		if err != nil {
+			r.logger.Debug("can not resolve device", zap.String("hostname", hostname), zap.Error(err))
+			return nil
+		}
+		for _, addr := range addrs {
+			byAddr[addr] = dev
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.byAddr = byAddr
+	r.lock.Unlock()
+	r.logger.Info("refreshed trap devices", zap.Int("devices", devs), zap.Int("addresses", len(byAddr)))
+
+	return nil
+}
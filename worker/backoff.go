@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+)
+
+type backoffState struct {
+	failures int
+	until    time.Time
+}
+
+// Backoff quarantines devices which keep failing. After a number of
+// consecutive failed polls a device is not polled for base, doubling with
+// every further failure up to max. A successful poll releases the device.
+type Backoff struct {
+	after int
+	base  time.Duration
+	max   time.Duration
+
+	lock    sync.Mutex
+	devices map[int32]*backoffState
+}
+
+// NewBackoff creates a backoff, after 0 disables quarantine.
+func NewBackoff(after int, base, max time.Duration) *Backoff {
+	return &Backoff{
+		after:   after,
+		base:    base,
+		max:     max,
+		devices: map[int32]*backoffState{},
+	}
+}
+
+// Allow tells if the device can be polled, otherwise it returns the end of
+// its quarantine.
+func (b *Backoff) Allow(deviceID int32, now time.Time) (bool, time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	state, ok := b.devices[deviceID]
+	if !ok || !now.Before(state.until) {
+		return true, time.Time{}
+	}
+	return false, state.until
+}
+
+// Record counts consecutive failures of a device, it returns them with the
+// end of the quarantine, zero when the device is not quarantined.
+func (b *Backoff) Record(deviceID int32, failed bool, now time.Time) (int, time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !failed {
+		delete(b.devices, deviceID)
+		return 0, time.Time{}
+	}
+	state, ok := b.devices[deviceID]
+	if !ok {
+		state = &backoffState{}
+		b.devices[deviceID] = state
+	}
+	state.failures++
+	if b.after <= 0 || state.failures < b.after {
+		return state.failures, time.Time{}
+	}
+
+	quarantine := b.base
+	for i := b.after; i < state.failures && quarantine < b.max; i++ {
+		quarantine *= 2
+	}
+	if quarantine > b.max {
+		quarantine = b.max
+	}
+	state.until = now.Add(quarantine)
+	return state.failures, state.until
+}
+
+// Failures returns consecutive failures of a device.
+func (b *Backoff) Failures(deviceID int32) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if state, ok := b.devices[deviceID]; ok {
+		return state.failures
+	}
+	return 0
+}
+
+// Retain forgets devices which are not in the list anymore.
+func (b *Backoff) Retain(devices []models.Device) {
+	keep := make(map[int32]bool, len(devices))
+	for _, dev := range devices {
+		keep[dev.DeviceID] = true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for id := range b.devices {
+		if !keep[id] {
+			delete(b.devices, id)
+		}
+	}
+}
@@ -2,120 +2,341 @@ package worker
 
 import (
 	"context"
-	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/logingood/yt-snmp-go-poller/devices/sql"
+	"github.com/logingood/yt-snmp-go-poller/devices"
 	"github.com/logingood/yt-snmp-go-poller/models"
 	"github.com/logingood/yt-snmp-go-poller/snmp"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
 
+// AvailabilityFunc receives reachability of every polled device.
+type AvailabilityFunc func(*models.DeviceAvailability)
+
+// ResultFunc receives the result of every device poll, including polls
+// skipped because the device is quarantined.
+type ResultFunc func(*models.PollResult)
+
+const (
+	PollOk          = "ok"
+	PollPartial     = "partial"
+	PollFailed      = "failed"
+	PollQuarantined = "quarantined"
+)
+
+// how often the scheduler is checked for due devices
+const scheduleResolution = time.Second
+
 type Queue struct {
 	logger       *zap.Logger
-	dbClient     *sql.Client
-	jobChan      chan *models.Device
-	interval     time.Duration
+	inventory    devices.Devices
+	ports        devices.Ports
+	jobs         *jobQueue
+	scheduler    *Scheduler
+	backoff      *Backoff
 	processor    snmp.DecorateFunc
+	sessions     *snmp.Pool
+	availability AvailabilityFunc
+	results      ResultFunc
+	policy       DevicePolicy
 	eg           *errgroup.Group
 	numWorkers   int
-	workerOffset int
-	workerRange  int
+	sharder      *Sharder
+	priorities   *Priorities
+	modules      *ModuleSchedule
+	rebalance    chan struct{}
+	dropped      atomic.Int64
+
+	portsLock    sync.Mutex
+	skippedPorts map[int32]map[int]bool
 }
 
-func New(logger *zap.Logger, dbClient *sql.Client, interval time.Duration, processor snmp.DecorateFunc, eg *errgroup.Group, numWorkers, queueLength, workerOffset, workerRange int) *Queue {
+func New(logger *zap.Logger, inventory devices.Devices, ports devices.Ports, scheduler *Scheduler, backoff *Backoff, processor snmp.DecorateFunc, sessions *snmp.Pool, availability AvailabilityFunc, results ResultFunc, policy DevicePolicy, sharder *Sharder, priorities *Priorities, modules *ModuleSchedule, eg *errgroup.Group, numWorkers, queueLength int) *Queue {
 	logger.Info("created new queue")
-	jobChan := make(chan *models.Device, queueLength)
 	return &Queue{
 		logger:       logger,
-		dbClient:     dbClient,
-		jobChan:      jobChan,
-		interval:     interval,
+		inventory:    inventory,
+		ports:        ports,
+		jobs:         newJobQueue(priorities.shares, queueLength),
+		scheduler:    scheduler,
+		backoff:      backoff,
 		processor:    processor,
+		sessions:     sessions,
+		availability: availability,
+		results:      results,
+		policy:       policy,
 		numWorkers:   numWorkers,
 		eg:           eg,
-		workerOffset: workerOffset,
-		workerRange:  workerRange,
+		sharder:      sharder,
+		priorities:   priorities,
+		modules:      modules,
+		rebalance:    make(chan struct{}, 1),
 	}
 }
 
+// StartDispatcher lists devices every interval and enqueues each device
+// when it is due according to the scheduler, higher priority classes are
+// polled first. The job queue is closed when the dispatcher returns, so
+// workers stop once it is drained.
 func (q *Queue) StartDispatcher(ctx context.Context) error {
-	// Create a new ticker with a period of 1 second.
-	ticker := time.NewTicker(q.interval)
-	q.logger.Info("start dispatcher to run every", zap.Any("interval", q.interval))
+	q.logger.Info("start dispatcher, devices are listed every", zap.Any("interval", q.scheduler.Interval()))
+	defer q.jobs.close()
+	if err := q.refreshDevices(ctx); err != nil {
+		return err
+	}
+
+	refresh := time.NewTicker(q.scheduler.Interval())
+	defer refresh.Stop()
+	schedule := time.NewTicker(scheduleResolution)
+	defer schedule.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			// TODO cache this call
-			q.logger.Info("woke up to list devices")
-			devices, err := q.dbClient.ListDevices(ctx)
-			if err != nil {
+		case <-refresh.C:
+			if err := q.refreshDevices(ctx); err != nil {
+				return err
+			}
+		case <-q.rebalance:
+			q.logger.Info("rebalancing devices")
+			if err := q.refreshDevices(ctx); err != nil {
 				return err
 			}
-			end := math.Min(float64(q.workerRange)+float64(q.workerOffset), float64(len(devices)))
-			devices = devices[q.workerOffset:int(end)]
-			q.logger.Info("found devices", zap.Int("devices", len(devices)))
-			for _, dev := range devices {
+		case now := <-schedule.C:
+			for _, dev := range q.scheduler.Due(now) {
 				dev := dev
-				q.logger.Info("enqueue snmp worker", zap.Any("device", dev.SysName))
-				q.jobChan <- &dev
+				if ok, until := q.backoff.Allow(dev.DeviceID, now); !ok {
+					q.scheduler.Release(dev.DeviceID)
+					q.logger.Debug("device is quarantined", zap.Int32("device_id", dev.DeviceID), zap.Time("until", until))
+					q.results(q.quarantinedResult(&dev, now, until))
+					continue
+				}
+				class := q.priorities.Class(&dev)
+				q.logger.Debug("enqueue snmp worker", zap.Any("device", dev.SysName), zap.String("class", q.priorities.classes[class]))
+				q.jobs.push(&dev, class)
 			}
 		case <-ctx.Done():
 			q.logger.Info("stopping dispatcher")
-			ticker.Stop()
 			return nil
 		}
 	}
 }
 
+// Rebalance makes the dispatcher list and split devices now, e.g. when
+// poller members changed.
+func (q *Queue) Rebalance() {
+	select {
+	case q.rebalance <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) refreshDevices(ctx context.Context) error {
+	q.logger.Info("woke up to list devices")
+	// the inventory list is shared, filters return new lists
+	devices, err := q.inventory.ListDevices(ctx)
+	if err != nil {
+		return err
+	}
+	devices = q.sharder.Filter(devices)
+	listed := len(devices)
+	devices = q.policy.Filter(devices)
+	q.logger.Info("found devices", zap.Int("devices", len(devices)), zap.Int("skipped", listed-len(devices)))
+	q.sessions.Retain(devices)
+	q.backoff.Retain(devices)
+	q.modules.Retain(devices)
+	q.scheduler.Update(devices, time.Now())
+	if err := q.refreshPorts(ctx); err != nil {
+		q.logger.Error("error refresh flagged ports, keep the previous ones", zap.Error(err))
+	}
+	if err := q.priorities.Refresh(ctx); err != nil {
+		q.logger.Error("error refresh device groups and attributes, keep the previous ones", zap.Error(err))
+	}
+
+	stats := q.scheduler.Stats()
+	q.logger.Info("polling overruns", zap.Int("overruns", stats.Overruns), zap.Int("skipped", stats.Skipped), zap.Int("delayed", stats.Delayed), zap.Int("in_flight", stats.InFlight))
+	queued := make(map[string]int, len(q.priorities.classes))
+	for class, n := range q.jobs.lens() {
+		queued[q.priorities.classes[class]] = n
+	}
+	q.logger.Info("queued polls", zap.Any("classes", queued))
+	if limits, ok := q.sessions.RateLimitStats(); ok {
+		q.logger.Info("snmp rate limiter", zap.Int64("packets", limits.Packets), zap.Int64("waits", limits.Waits), zap.Duration("waited", limits.Waited))
+	}
+	return nil
+}
+
 func (q *Queue) StartWorkerPool(ctx context.Context) error {
 	q.logger.Info("starting worker pool", zap.Any("workers", q.numWorkers))
 	for i := 0; i < q.numWorkers; i++ {
 		q.eg.Go(func() error {
-			for job := range q.jobChan {
-				job := job
+			for {
+				job, ok := q.jobs.pop()
+				if !ok {
+					return nil
+				}
 				if err := q.worker(ctx, job); err != nil {
 					return err
 				}
 			}
-			return nil
 		})
 	}
 
 	return nil
 }
 
+// Dropped returns how many queued polls were not started because the
+// poller was stopping.
+func (q *Queue) Dropped() int64 {
+	return q.dropped.Load()
+}
+
+// worker polls a device. Once ctx is cancelled queued jobs are dropped, but
+// a poll which already started runs to the end so its results are stored.
 func (q *Queue) worker(ctx context.Context, job *models.Device) error {
 	q.logger.Info("starting a worker")
 	select {
 	case <-ctx.Done():
-		q.logger.Info("worker is shutting down")
+		q.logger.Debug("dropping queued poll, worker is shutting down", zap.Int32("device_id", job.DeviceID))
+		q.scheduler.Release(job.DeviceID)
+		q.dropped.Add(1)
 		return nil
 	default:
 		q.logger.Info("received a job to process", zap.Any("device", job.Hostname))
-		q.process(job)
-		if ctx.Err() != nil {
-			return ctx.Err()
+		cadence := q.scheduler.Started(job.DeviceID, time.Now())
+		q.logger.Debug("polling cadence", zap.Int32("device_id", job.DeviceID), zap.Duration("interval", cadence.Interval), zap.Duration("last", cadence.Last), zap.Duration("avg", cadence.Avg))
+		started := time.Now()
+		snmpMap, err := q.process(ctx, job)
+		q.results(q.pollResult(job, started, snmpMap, err))
+		if took, overrun := q.scheduler.Finished(job.DeviceID, time.Now()); overrun {
+			q.logger.Warn("poll took longer than the interval", zap.Int32("device_id", job.DeviceID), zap.Any("device", job.Hostname), zap.Duration("took", took), zap.Duration("interval", cadence.Interval))
 		}
+		q.availability(q.availabilitySample(job, err))
 		return nil
 	}
 }
 
-func (q *Queue) process(job *models.Device) error {
-	s := snmp.New(job, q.logger)
+func (q *Queue) process(ctx context.Context, job *models.Device) (*models.SnmpInterfaceMetrics, error) {
+	started := time.Now()
 	snmpMap := &models.SnmpInterfaceMetrics{}
+	s, err := q.sessions.Get(ctx, job)
+	if err != nil {
+		q.logger.Error("error get snmp session", zap.Error(err), zap.Any("device", job.Hostname))
+		q.sessions.Invalidate(job.DeviceID)
+		return snmpMap, err
+	}
 	poller := snmp.Compose(
-		// do something with the device
-		q.processor,
+		func(*models.SnmpInterfaceMetrics) error { return nil },
+		q.skipPorts,
 
 		// adding snmp properties and counters
-		s.SetCounters,
+		q.module(job, snmp.CollectorOspf, started, s.SetOspf),
+		q.module(job, snmp.CollectorCpu, started, s.SetCpu),
+		q.module(job, snmp.CollectorCounters, started, s.SetCounters),
 		s.GetInterfacesMap, // always keep at the bottom
 	)
-	if err := poller(snmpMap); err != nil {
-		return err
+	err = poller(snmpMap)
+	q.modules.Ran(job.DeviceID, snmpMap.Collectors, started)
+	snmpMap.RateLimitWait = s.TakeRateLimitWait()
+	if err != nil {
+		// a new session renegotiates v3 state on the next poll
+		q.sessions.Invalidate(job.DeviceID)
+		return snmpMap, err
 	}
-	return nil
+	// a storage error is not the device's fault, it does not count towards
+	// the quarantine or availability
+	if err := q.processor(snmpMap); err != nil {
+		q.logger.Error("error store poll", zap.Error(err), zap.Int32("device_id", job.DeviceID), zap.Any("device", job.Hostname))
+	}
+	return snmpMap, nil
+}
+
+// pollResult summarises a poll from its collectors and counts failures
+// towards the device quarantine. A poll which got interfaces and counters
+// is not a failure even if other collectors failed.
+func (q *Queue) pollResult(job *models.Device, started time.Time, snmpMap *models.SnmpInterfaceMetrics, err error) *models.PollResult {
+	now := time.Now()
+	result := newPollResult(job, now)
+	result.DurationMs = float64(now.Sub(started)) / float64(time.Millisecond)
+	result.RateLimitWaitMs = float64(snmpMap.RateLimitWait) / float64(time.Millisecond)
+	result.Status = PollOk
+	result.CollectorStatus = make(map[string]string, len(snmpMap.Collectors))
+	result.CollectorDurationMs = make(map[string]float64, len(snmpMap.Collectors))
+	for _, collector := range snmpMap.Collectors {
+		result.CollectorStatus[collector.Name] = collector.Status
+		result.CollectorDurationMs[collector.Name] = float64(collector.Duration) / float64(time.Millisecond)
+		if collector.Status != snmp.CollectorOk && result.Status == PollOk {
+			result.Status = PollPartial
+			result.ErrorClass = collector.ErrorClass
+			result.Error = collector.Error
+		}
+	}
+	if err != nil {
+		result.Status = PollFailed
+		result.ErrorClass = snmp.ClassifyError(err)
+		result.Error = err.Error()
+	}
+
+	failures, until := q.backoff.Record(job.DeviceID, err != nil, now)
+	result.ConsecutiveFailures = int32(failures)
+	if !until.IsZero() {
+		result.QuarantinedUntil = until.UTC().Unix()
+		q.logger.Warn("device quarantined", zap.Int32("device_id", job.DeviceID), zap.Any("device", job.Hostname), zap.Int("failures", failures), zap.Time("until", until), zap.String("error_class", result.ErrorClass))
+	}
+	return result
+}
+
+func (q *Queue) quarantinedResult(job *models.Device, now, until time.Time) *models.PollResult {
+	result := newPollResult(job, now)
+	result.Status = PollQuarantined
+	result.ConsecutiveFailures = int32(q.backoff.Failures(job.DeviceID))
+	result.QuarantinedUntil = until.UTC().Unix()
+	return result
+}
+
+func newPollResult(job *models.Device, now time.Time) *models.PollResult {
+	result := &models.PollResult{
+		Time:        now.UTC().Unix(),
+		DeviceID:    job.DeviceID,
+		PollerGroup: job.PollerGroup,
+	}
+	if job.Hostname != nil {
+		result.Hostname = *job.Hostname
+	}
+	if job.SysName != nil {
+		result.SysName = *job.SysName
+	}
+	return result
+}
+
+// availabilitySample tells if the device answered, any response from the
+// agent, even an error or a v3 report, means it is reachable.
+func (q *Queue) availabilitySample(job *models.Device, err error) *models.DeviceAvailability {
+	sample := &models.DeviceAvailability{
+		Time:        time.Now().UTC().Unix(),
+		DeviceID:    job.DeviceID,
+		PollerGroup: job.PollerGroup,
+		ErrorClass:  snmp.ClassifyError(err),
+	}
+	if job.Hostname != nil {
+		sample.Hostname = *job.Hostname
+	}
+	if job.SysName != nil {
+		sample.SysName = *job.SysName
+	}
+	if err != nil {
+		sample.Error = err.Error()
+	}
+	switch sample.ErrorClass {
+	case snmp.ErrorClassTimeout, snmp.ErrorClassNetwork, snmp.ErrorClassBadConfig:
+	default:
+		sample.Reachable = true
+		if stats, ok := q.sessions.Rtt(job.DeviceID); ok {
+			sample.ResponseTimeMs = float64(stats.Last) / float64(time.Millisecond)
+		}
+	}
+
+	return sample
 }
@@ -0,0 +1,99 @@
+package worker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/snmp"
+	"go.uber.org/zap"
+)
+
+// modules which can run less often than the device is polled, interfaces
+// are walked on every poll as the other modules need them.
+var scheduledModules = map[string]bool{
+	snmp.CollectorCounters: true,
+	snmp.CollectorCpu:      true,
+	snmp.CollectorOspf:     true,
+}
+
+// ModuleSchedule runs collector modules of a device on their own intervals.
+// A module is run on the first poll after its interval passed, intervals
+// shorter than the device interval run it on every poll. A failed module is
+// run again on the next poll.
+type ModuleSchedule struct {
+	intervals map[string]time.Duration
+
+	lock sync.Mutex
+	last map[int32]map[string]time.Time
+}
+
+func NewModuleSchedule(intervals map[string]time.Duration) (*ModuleSchedule, error) {
+	for module := range intervals {
+		if !scheduledModules[module] {
+			return nil, fmt.Errorf("module %q can not have its own interval", module)
+		}
+	}
+	return &ModuleSchedule{
+		intervals: intervals,
+		last:      map[int32]map[string]time.Time{},
+	}, nil
+}
+
+// Due tells if a module runs on a poll of a device at now. Polls drift, so
+// a module is due half a device interval early rather than a whole one late.
+func (m *ModuleSchedule) Due(deviceID int32, module string, now time.Time, deviceInterval time.Duration) bool {
+	interval, ok := m.intervals[module]
+	if !ok || interval <= deviceInterval {
+		return true
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	last := m.last[deviceID][module]
+	return last.IsZero() || now.Sub(last) >= interval-deviceInterval/2
+}
+
+// Ran records modules which succeeded in a poll started at started.
+func (m *ModuleSchedule) Ran(deviceID int32, collectors []models.CollectorResult, started time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, collector := range collectors {
+		if _, ok := m.intervals[collector.Name]; !ok || collector.Status != snmp.CollectorOk {
+			continue
+		}
+		if m.last[deviceID] == nil {
+			m.last[deviceID] = map[string]time.Time{}
+		}
+		m.last[deviceID][collector.Name] = started
+	}
+}
+
+// Retain forgets devices which are not in the list anymore.
+func (m *ModuleSchedule) Retain(devices []models.Device) {
+	keep := make(map[int32]struct{}, len(devices))
+	for _, dev := range devices {
+		keep[dev.DeviceID] = struct{}{}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for deviceID := range m.last {
+		if _, ok := keep[deviceID]; !ok {
+			delete(m.last, deviceID)
+		}
+	}
+}
+
+// module skips a collector decorator when it is not due.
+func (q *Queue) module(job *models.Device, name string, started time.Time, decorator snmp.Decorator) snmp.Decorator {
+	cadence, _ := q.scheduler.Cadence(job.DeviceID)
+	if q.modules.Due(job.DeviceID, name, started, cadence.Interval) {
+		return decorator
+	}
+	q.logger.Debug("module is not due", zap.Int32("device_id", job.DeviceID), zap.String("module", name))
+	return func(next snmp.DecorateFunc) snmp.DecorateFunc {
+		return next
+	}
+}
@@ -0,0 +1,81 @@
+package worker
+
+import (
+	"context"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"github.com/logingood/yt-snmp-go-poller/snmp"
+	"go.uber.org/zap"
+)
+
+// DevicePolicy tells which LibreNMS flags of devices and ports are
+// respected, devices which are down are handled by the scheduler.
+type DevicePolicy struct {
+	SkipDisabled      bool
+	SkipIgnored       bool
+	SkipDisabledPorts bool
+	SkipIgnoredPorts  bool
+}
+
+// Filter returns devices to poll.
+func (p DevicePolicy) Filter(devices []models.Device) []models.Device {
+	kept := make([]models.Device, 0, len(devices))
+	for _, dev := range devices {
+		if p.SkipDisabled && dev.Disabled {
+			continue
+		}
+		if p.SkipIgnored && dev.Ignore {
+			continue
+		}
+		kept = append(kept, dev)
+	}
+	return kept
+}
+
+func (p DevicePolicy) skipsPorts() bool {
+	return p.SkipDisabledPorts || p.SkipIgnoredPorts
+}
+
+// refreshPorts reads flagged ports, on error the previous ports are kept.
+func (q *Queue) refreshPorts(ctx context.Context) error {
+	if !q.policy.skipsPorts() {
+		return nil
+	}
+	ports, err := q.ports.ListFlaggedPorts(ctx)
+	if err != nil {
+		return err
+	}
+
+	skipped := map[int32]map[int]bool{}
+	count := 0
+	for _, port := range ports {
+		if !(q.policy.SkipDisabledPorts && port.Disabled) && !(q.policy.SkipIgnoredPorts && port.Ignore) {
+			continue
+		}
+		if skipped[port.DeviceID] == nil {
+			skipped[port.DeviceID] = map[int]bool{}
+		}
+		skipped[port.DeviceID][port.IfIndex] = true
+		count++
+	}
+	q.logger.Info("found skipped ports", zap.Int("ports", count))
+
+	q.portsLock.Lock()
+	q.skippedPorts = skipped
+	q.portsLock.Unlock()
+	return nil
+}
+
+// skipPorts is a decorator which drops skipped ports of the device.
+func (q *Queue) skipPorts(decorator snmp.DecorateFunc) snmp.DecorateFunc {
+	return func(metricsMap *models.SnmpInterfaceMetrics) error {
+		q.portsLock.Lock()
+		skipped := q.skippedPorts[metricsMap.DeviceID]
+		q.portsLock.Unlock()
+
+		for ifIndex := range skipped {
+			delete(metricsMap.CountersMap, ifIndex)
+		}
+		return decorator(metricsMap)
+	}
+}
@@ -0,0 +1,288 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/logingood/yt-snmp-go-poller/devices"
+	"github.com/logingood/yt-snmp-go-poller/models"
+)
+
+// PriorityRules assign devices to priority classes, a device id rule wins
+// over a LibreNMS device attribute, then a device group rule and then an os
+// rule. Devices matching no rule are in the lowest class.
+type PriorityRules struct {
+	// class names, highest first
+	Classes []string
+	// share of polls guaranteed to every class below the highest while
+	// higher classes are waiting, per class overrides in Shares
+	MinShare float64
+	Shares   map[string]float64
+	Devices  map[int32]string
+	Groups   map[int32]string
+	OS       map[string]string
+	// Attrib is a LibreNMS device attribute type whose value is the class
+	// name of the device, values which are not class names are ignored
+	Attrib string
+}
+
+// PrioritySource reads LibreNMS device groups and attributes.
+type PrioritySource interface {
+	devices.Groups
+	devices.Attribs
+}
+
+// Priorities resolves the class of a device, group and attribute rules use
+// LibreNMS device group membership and attributes read on Refresh.
+type Priorities struct {
+	classes []string
+	index   map[string]int
+	shares  []float64
+	devices map[int32]int
+	groups  map[int32]int
+	os      map[string]int
+	attrib  string
+	source  PrioritySource
+
+	lock       sync.Mutex
+	membership map[int32][]int32
+	attribs    map[int32]int
+}
+
+// NewPriorities validates rules, with no classes every device has the same
+// priority.
+func NewPriorities(rules PriorityRules, source PrioritySource) (*Priorities, error) {
+	classes := rules.Classes
+	if len(classes) == 0 {
+		classes = []string{"default"}
+	}
+	index := make(map[string]int, len(classes))
+	for i, class := range classes {
+		index[class] = i
+	}
+	lookup := func(class string) (int, error) {
+		i, ok := index[class]
+		if !ok {
+			return 0, fmt.Errorf("unknown priority class %q", class)
+		}
+		return i, nil
+	}
+
+	p := &Priorities{
+		classes: classes,
+		index:   index,
+		shares:  make([]float64, len(classes)),
+		devices: make(map[int32]int, len(rules.Devices)),
+		groups:  make(map[int32]int, len(rules.Groups)),
+		os:      make(map[string]int, len(rules.OS)),
+		attrib:  rules.Attrib,
+		source:  source,
+	}
+	if rules.MinShare < 0 || rules.MinShare > 1 {
+		return nil, fmt.Errorf("minimum share of priority classes must be within 0 and 1")
+	}
+	for i := 1; i < len(classes); i++ {
+		p.shares[i] = rules.MinShare
+	}
+	for class, share := range rules.Shares {
+		i, err := lookup(class)
+		if err != nil {
+			return nil, err
+		}
+		if share < 0 || share > 1 {
+			return nil, fmt.Errorf("share of priority class %q must be within 0 and 1", class)
+		}
+		p.shares[i] = share
+	}
+	for id, class := range rules.Devices {
+		i, err := lookup(class)
+		if err != nil {
+			return nil, err
+		}
+		p.devices[id] = i
+	}
+	for group, class := range rules.Groups {
+		i, err := lookup(class)
+		if err != nil {
+			return nil, err
+		}
+		p.groups[group] = i
+	}
+	for os, class := range rules.OS {
+		i, err := lookup(class)
+		if err != nil {
+			return nil, err
+		}
+		p.os[os] = i
+	}
+	return p, nil
+}
+
+// Classes returns class names, highest first.
+func (p *Priorities) Classes() []string {
+	return p.classes
+}
+
+// Refresh reads device group membership if there are group rules and the
+// attribute if there is one, on error the previous ones are kept.
+func (p *Priorities) Refresh(ctx context.Context) error {
+	if p.source == nil {
+		return nil
+	}
+	if len(p.groups) > 0 {
+		membership, err := p.source.ListDeviceGroups(ctx)
+		if err != nil {
+			return err
+		}
+		p.lock.Lock()
+		p.membership = membership
+		p.lock.Unlock()
+	}
+	if p.attrib != "" {
+		values, err := p.source.ListDeviceAttribs(ctx, p.attrib)
+		if err != nil {
+			return err
+		}
+		attribs := make(map[int32]int, len(values))
+		for id, class := range values {
+			if i, ok := p.index[class]; ok {
+				attribs[id] = i
+			}
+		}
+		p.lock.Lock()
+		p.attribs = attribs
+		p.lock.Unlock()
+	}
+	return nil
+}
+
+// Class returns the class index of a device, 0 is the highest.
+func (p *Priorities) Class(dev *models.Device) int {
+	if i, ok := p.devices[dev.DeviceID]; ok {
+		return i
+	}
+	if p.attrib != "" {
+		p.lock.Lock()
+		i, ok := p.attribs[dev.DeviceID]
+		p.lock.Unlock()
+		if ok {
+			return i
+		}
+	}
+	if len(p.groups) > 0 {
+		p.lock.Lock()
+		groups := p.membership[dev.DeviceID]
+		p.lock.Unlock()
+		// the highest class of the device's groups
+		class := -1
+		for _, group := range groups {
+			if i, ok := p.groups[group]; ok && (class < 0 || i < class) {
+				class = i
+			}
+		}
+		if class >= 0 {
+			return class
+		}
+	}
+	if dev.OS != nil {
+		if i, ok := p.os[*dev.OS]; ok {
+			return i
+		}
+	}
+	return len(p.classes) - 1
+}
+
+// jobQueue holds due devices per class. Higher classes are polled first,
+// a lower class earns its share of credit on every poll it waits for and
+// is polled once it has a full credit, so it is never starved. A device
+// is queued at most once, so the queue is bounded by the device count.
+type jobQueue struct {
+	lock    sync.Mutex
+	ready   *sync.Cond
+	classes [][]*models.Device
+	shares  []float64
+	credits []float64
+	closed  bool
+}
+
+func newJobQueue(shares []float64, capacity int) *jobQueue {
+	q := &jobQueue{
+		classes: make([][]*models.Device, len(shares)),
+		shares:  shares,
+		credits: make([]float64, len(shares)),
+	}
+	q.classes[len(shares)-1] = make([]*models.Device, 0, capacity)
+	q.ready = sync.NewCond(&q.lock)
+	return q
+}
+
+func (q *jobQueue) push(dev *models.Device, class int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.classes[class] = append(q.classes[class], dev)
+	q.ready.Signal()
+}
+
+// pop blocks until a device is queued, it returns false once the queue is
+// closed and empty.
+func (q *jobQueue) pop() (*models.Device, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for {
+		if class, ok := q.next(); ok {
+			dev := q.classes[class][0]
+			q.classes[class][0] = nil
+			q.classes[class] = q.classes[class][1:]
+			return dev, true
+		}
+		if q.closed {
+			return nil, false
+		}
+		q.ready.Wait()
+	}
+}
+
+func (q *jobQueue) next() (int, bool) {
+	highest, credited := -1, -1
+	for class, jobs := range q.classes {
+		if len(jobs) == 0 {
+			q.credits[class] = 0
+			continue
+		}
+		if highest < 0 {
+			highest = class
+			continue
+		}
+		if q.credits[class] < 1 {
+			q.credits[class] += q.shares[class]
+		}
+		// shares like 0.1 don't add up to exactly 1
+		if credited < 0 && q.credits[class] >= 1-1e-9 {
+			credited = class
+		}
+	}
+	if credited >= 0 {
+		q.credits[credited]--
+		return credited, true
+	}
+	return highest, highest >= 0
+}
+
+func (q *jobQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.ready.Broadcast()
+}
+
+// lens returns queued devices per class.
+func (q *jobQueue) lens() []int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	lens := make([]int, len(q.classes))
+	for class, jobs := range q.classes {
+		lens[class] = len(jobs)
+	}
+	return lens
+}
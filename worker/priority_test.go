@@ -0,0 +1,74 @@
+package worker
+
+import (
+	"math"
+	"testing"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+)
+
+func TestJobQueueMinShare(t *testing.T) {
+	const (
+		queued = 10000
+		pops   = 1000
+	)
+	cases := []struct {
+		name   string
+		shares []float64
+		// share of pops per class while every class is saturated
+		want []float64
+	}{
+		{"one class", []float64{0}, []float64{1}},
+		{"tenth", []float64{0, 0.1}, []float64{0.9, 0.1}},
+		{"quarter", []float64{0, 0.25}, []float64{0.75, 0.25}},
+		{"half", []float64{0, 0.5}, []float64{0.5, 0.5}},
+		{"starved", []float64{0, 0}, []float64{1, 0}},
+		{"three classes", []float64{0, 0.1, 0.2}, []float64{0.7, 0.1, 0.2}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := newJobQueue(tc.shares, queued)
+			for class := range tc.shares {
+				for i := 0; i < queued; i++ {
+					// the device id is the class, to count pops
+					q.push(&models.Device{DeviceID: int32(class)}, class)
+				}
+			}
+			counts := make([]int, len(tc.shares))
+			for i := 0; i < pops; i++ {
+				dev, ok := q.pop()
+				if !ok {
+					t.Fatal("queue closed")
+				}
+				counts[dev.DeviceID]++
+			}
+			for class, want := range tc.want {
+				if got := float64(counts[class]) / pops; math.Abs(got-want) > 0.01 {
+					t.Errorf("class %d got %.3f of pops, want %.3f", class, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestJobQueueLowerClassAlone(t *testing.T) {
+	q := newJobQueue([]float64{0, 0.1}, 10)
+	for i := 0; i < 5; i++ {
+		q.push(&models.Device{DeviceID: 1}, 1)
+	}
+	q.push(&models.Device{DeviceID: 0}, 0)
+	// the higher class goes first, then the lower one needs no credit
+	for i, want := range []int32{0, 1, 1, 1, 1, 1} {
+		dev, ok := q.pop()
+		if !ok {
+			t.Fatalf("pop %d: queue closed", i)
+		}
+		if dev.DeviceID != want {
+			t.Fatalf("pop %d got class %d, want %d", i, dev.DeviceID, want)
+		}
+	}
+	q.close()
+	if _, ok := q.pop(); ok {
+		t.Error("pop of a closed empty queue returned a device")
+	}
+}
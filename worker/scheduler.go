@@ -0,0 +1,300 @@
+package worker
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+)
+
+// Overrun policies decide what happens when a device is due while its
+// previous poll is still queued or running. A device is never polled twice
+// at the same time.
+const (
+	// OverrunSkip drops the slot, the device is polled at its next slot.
+	OverrunSkip = "skip"
+	// OverrunDelay polls the device as soon as the previous poll finishes,
+	// its next slots shift accordingly.
+	OverrunDelay = "delay"
+	// OverrunCatchUp polls missed slots back to back until the device is
+	// on schedule again, at most maxCatchUpSlots of them.
+	OverrunCatchUp = "catch-up"
+)
+
+const maxCatchUpSlots = 3
+
+// Cadence is how often a device is actually polled, it drifts from the
+// configured interval when workers are busy.
+type Cadence struct {
+	Interval time.Duration // configured
+	Last     time.Duration // between the last two polls
+	Avg      time.Duration // moving average
+	Polls    int
+	// polls which took longer than the interval
+	Overruns int
+	// slots skipped or delayed because the device was still polled
+	Skipped int
+	Delayed int
+}
+
+// OverrunStats are totals of all devices since start.
+type OverrunStats struct {
+	Overruns int
+	Skipped  int
+	Delayed  int
+	InFlight int
+}
+
+type scheduleEntry struct {
+	device   models.Device
+	interval time.Duration
+	next     time.Time
+	started  time.Time
+	cadence  Cadence
+	inFlight bool
+	delayed  bool
+}
+
+// Scheduler gives every device its own due time. The first poll of a device
+// is delayed by a jitter derived from its id, so devices are spread across
+// the interval instead of being polled all at once, and keep their slot
+// when other devices come and go.
+type Scheduler struct {
+	interval  time.Duration
+	intervals map[int32]time.Duration
+	policy    string
+	// devices LibreNMS marked down are polled so many times less often
+	downFactor int
+
+	lock    sync.Mutex
+	entries map[int32]*scheduleEntry
+	stats   OverrunStats
+}
+
+// NewScheduler creates a scheduler, intervals are per device overrides of
+// the default interval. Intervals of devices which are down are multiplied
+// by downFactor, 0 or 1 polls them as usual.
+func NewScheduler(interval time.Duration, intervals map[int32]time.Duration, policy string, downFactor int) (*Scheduler, error) {
+	switch policy {
+	case OverrunSkip, OverrunDelay, OverrunCatchUp:
+	default:
+		return nil, fmt.Errorf("unknown overrun policy %q", policy)
+	}
+	return &Scheduler{
+		interval:   interval,
+		intervals:  intervals,
+		policy:     policy,
+		downFactor: downFactor,
+		entries:    map[int32]*scheduleEntry{},
+	}, nil
+}
+
+// Interval is the default polling interval.
+func (s *Scheduler) Interval() time.Duration {
+	return s.interval
+}
+
+// Update sets the devices to poll, new devices are scheduled within their
+// interval and removed devices are forgotten.
+func (s *Scheduler) Update(devices []models.Device, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seen := make(map[int32]bool, len(devices))
+	for _, dev := range devices {
+		seen[dev.DeviceID] = true
+		interval := s.deviceInterval(dev)
+		entry, ok := s.entries[dev.DeviceID]
+		if !ok {
+			s.entries[dev.DeviceID] = &scheduleEntry{
+				device:   dev,
+				interval: interval,
+				next:     now.Add(jitter(dev.DeviceID, interval)),
+				cadence:  Cadence{Interval: interval},
+			}
+			continue
+		}
+		entry.device = dev
+		if entry.interval != interval {
+			entry.interval = interval
+			entry.cadence.Interval = interval
+			entry.next = now.Add(jitter(dev.DeviceID, interval))
+		}
+	}
+	for id, entry := range s.entries {
+		if !seen[id] {
+			if entry.inFlight {
+				s.stats.InFlight--
+			}
+			delete(s.entries, id)
+		}
+	}
+}
+
+// Due returns devices whose due time passed, earliest first, and marks
+// them in flight until Finished is called. Devices still in flight are
+// handled by the overrun policy.
+func (s *Scheduler) Due(now time.Time) []models.Device {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var due []*scheduleEntry
+	for _, entry := range s.entries {
+		if entry.next.After(now) {
+			continue
+		}
+		if !entry.inFlight {
+			due = append(due, entry)
+			continue
+		}
+		switch s.policy {
+		case OverrunSkip:
+			skipped := s.skipAhead(entry, now)
+			entry.cadence.Skipped += skipped
+			s.stats.Skipped += skipped
+		default:
+			// polled again when the current poll finishes
+			if !entry.delayed {
+				entry.delayed = true
+				entry.cadence.Delayed++
+				s.stats.Delayed++
+			}
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].next.Before(due[j].next)
+	})
+
+	devices := make([]models.Device, 0, len(due))
+	for _, entry := range due {
+		devices = append(devices, entry.device)
+		entry.inFlight = true
+		s.stats.InFlight++
+
+		switch {
+		case s.policy == OverrunDelay && entry.delayed:
+			entry.next = now.Add(entry.interval)
+		case s.policy == OverrunCatchUp && now.Sub(entry.next) < maxCatchUpSlots*entry.interval:
+			entry.next = entry.next.Add(entry.interval)
+		default:
+			entry.next = entry.next.Add(entry.interval)
+			skipped := s.skipAhead(entry, now)
+			entry.cadence.Skipped += skipped
+			s.stats.Skipped += skipped
+		}
+		entry.delayed = false
+	}
+	return devices
+}
+
+// skipAhead moves a due entry to its first slot after now keeping its
+// phase and returns the number of slots skipped.
+func (s *Scheduler) skipAhead(entry *scheduleEntry, now time.Time) int {
+	if entry.next.After(now) {
+		return 0
+	}
+	missed := now.Sub(entry.next)/entry.interval + 1
+	entry.next = entry.next.Add(missed * entry.interval)
+	return int(missed)
+}
+
+// Finished clears the in flight mark of a device and tells if the poll
+// took longer than the device interval.
+func (s *Scheduler) Finished(deviceID int32, at time.Time) (time.Duration, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.entries[deviceID]
+	if !ok || !entry.inFlight {
+		return 0, false
+	}
+	entry.inFlight = false
+	s.stats.InFlight--
+	if entry.started.IsZero() {
+		return 0, false
+	}
+	took := at.Sub(entry.started)
+	if took <= entry.interval {
+		return took, false
+	}
+	entry.cadence.Overruns++
+	s.stats.Overruns++
+	return took, true
+}
+
+// Release clears the in flight mark of a device which was due but is not
+// polled.
+func (s *Scheduler) Release(deviceID int32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if entry, ok := s.entries[deviceID]; ok && entry.inFlight {
+		entry.inFlight = false
+		s.stats.InFlight--
+	}
+}
+
+// Stats returns overrun totals.
+func (s *Scheduler) Stats() OverrunStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
+
+// Started records the start of a poll to track the actual cadence.
+func (s *Scheduler) Started(deviceID int32, at time.Time) Cadence {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.entries[deviceID]
+	if !ok {
+		return Cadence{}
+	}
+	if !entry.started.IsZero() {
+		last := at.Sub(entry.started)
+		entry.cadence.Last = last
+		if entry.cadence.Avg == 0 {
+			entry.cadence.Avg = last
+		} else {
+			// same weight as srtt in RFC 6298
+			entry.cadence.Avg += (last - entry.cadence.Avg) / 8
+		}
+	}
+	entry.started = at
+	entry.cadence.Polls++
+	return entry.cadence
+}
+
+// Cadence returns the actual polling cadence of a device.
+func (s *Scheduler) Cadence(deviceID int32) (Cadence, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.entries[deviceID]
+	if !ok {
+		return Cadence{}, false
+	}
+	return entry.cadence, true
+}
+
+func (s *Scheduler) deviceInterval(dev models.Device) time.Duration {
+	interval := s.interval
+	if override, ok := s.intervals[dev.DeviceID]; ok && override > 0 {
+		interval = override
+	}
+	if !dev.Status && s.downFactor > 1 {
+		interval *= time.Duration(s.downFactor)
+	}
+	return interval
+}
+
+// jitter is a stable offset within the interval.
+func jitter(deviceID int32, interval time.Duration) time.Duration {
+	h := fnv.New32a()
+	h.Write([]byte(strconv.Itoa(int(deviceID))))
+	return time.Duration(float64(h.Sum32()) / (1 << 32) * float64(interval))
+}
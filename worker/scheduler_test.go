@@ -0,0 +1,103 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+)
+
+func TestSchedulerOverrun(t *testing.T) {
+	const interval = time.Minute
+	cases := []struct {
+		name   string
+		policy string
+		// how long the poll of the first slot takes
+		took time.Duration
+		// polls started back to back once it finished
+		polls   int
+		skipped int
+		delayed int
+		// next slot after the first one
+		next time.Duration
+	}{
+		{"skip", OverrunSkip, 2*interval + interval/2, 0, 2, 0, 3 * interval},
+		{"delay", OverrunDelay, 2*interval + interval/2, 1, 0, 1, 3*interval + interval/2},
+		{"catch-up", OverrunCatchUp, 2*interval + interval/2, 2, 0, 1, 3 * interval},
+		// older slots than maxCatchUpSlots are skipped
+		{"catch-up cap", OverrunCatchUp, 5*interval + interval/2, 1, 4, 1, 6 * interval},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := NewScheduler(interval, nil, tc.policy, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Unix(0, 0)
+			s.Update([]models.Device{{DeviceID: 1, Status: true}}, start)
+			first := start.Add(jitter(1, interval))
+
+			if due := s.Due(first); len(due) != 1 {
+				t.Fatalf("%d devices due at the first slot, want 1", len(due))
+			}
+			s.Started(1, first)
+			now := first.Add(tc.took)
+			if due := s.Due(now); len(due) != 0 {
+				t.Fatalf("device in flight is due again")
+			}
+			if _, overrun := s.Finished(1, now); !overrun {
+				t.Fatalf("poll which took %s is not an overrun", tc.took)
+			}
+
+			polls := 0
+			for ; polls <= maxCatchUpSlots; polls++ {
+				if len(s.Due(now)) == 0 {
+					break
+				}
+				s.Finished(1, now)
+			}
+			if polls != tc.polls {
+				t.Errorf("%d polls after the overrun, want %d", polls, tc.polls)
+			}
+			stats := s.Stats()
+			if stats.Skipped != tc.skipped || stats.Delayed != tc.delayed {
+				t.Errorf("skipped %d delayed %d, want %d and %d", stats.Skipped, stats.Delayed, tc.skipped, tc.delayed)
+			}
+			if stats.InFlight != 0 {
+				t.Errorf("%d polls in flight, want 0", stats.InFlight)
+			}
+			if next := s.entries[1].next.Sub(first); next != tc.next {
+				t.Errorf("next slot %s after the first one, want %s", next, tc.next)
+			}
+		})
+	}
+}
+
+func TestSchedulerOnTime(t *testing.T) {
+	const interval = time.Minute
+	for _, policy := range []string{OverrunSkip, OverrunDelay, OverrunCatchUp} {
+		s, err := NewScheduler(interval, nil, policy, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Unix(0, 0)
+		s.Update([]models.Device{{DeviceID: 1, Status: true}}, start)
+		slot := start.Add(jitter(1, interval))
+		for i := 0; i < 3; i++ {
+			if due := s.Due(slot); len(due) != 1 {
+				t.Fatalf("%s: %d devices due at slot %d, want 1", policy, len(due), i)
+			}
+			s.Started(1, slot)
+			if _, overrun := s.Finished(1, slot.Add(interval/2)); overrun {
+				t.Fatalf("%s: poll within the interval is an overrun", policy)
+			}
+			if due := s.Due(slot.Add(interval / 2)); len(due) != 0 {
+				t.Fatalf("%s: device due before its next slot", policy)
+			}
+			slot = slot.Add(interval)
+		}
+		if stats := s.Stats(); stats != (OverrunStats{}) {
+			t.Errorf("%s: stats %+v, want none", policy, stats)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package worker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/logingood/yt-snmp-go-poller/models"
+	"go.uber.org/zap"
+)
+
+// Sharder splits devices between poller instances with rendezvous hashing,
+// every device is owned by the member with the highest hash of device id
+// and member name. A device only moves when its owner leaves or a new
+// member wins it, so about 1/n of devices move when a member is added.
+type Sharder struct {
+	logger *zap.Logger
+	self   string
+
+	lock    sync.Mutex
+	members []string
+	owned   map[int32]bool
+}
+
+// NewSharder creates a sharder of count static members named by their
+// index, self is the index of this instance.
+func NewSharder(logger *zap.Logger, count, index int) (*Sharder, error) {
+	if count < 1 || index < 0 || index >= count {
+		return nil, fmt.Errorf("shard index %d out of %d shards", index, count)
+	}
+	members := make([]string, count)
+	for i := range members {
+		members[i] = strconv.Itoa(i)
+	}
+	return &Sharder{
+		logger:  logger,
+		self:    members[index],
+		members: members,
+	}, nil
+}
+
+// NewMemberSharder creates a sharder whose members are set by cluster
+// membership, until then this instance owns every device.
+func NewMemberSharder(logger *zap.Logger, self string) *Sharder {
+	return &Sharder{
+		logger:  logger,
+		self:    self,
+		members: []string{self},
+	}
+}
+
+// SetMembers replaces members, ownership changes on the next Filter.
+func (s *Sharder) SetMembers(members []string) {
+	sorted := append([]string(nil), members...)
+	sort.Strings(sorted)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.members = sorted
+}
+
+// Owner returns the member which polls the device.
+func (s *Sharder) Owner(deviceID int32) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.owner(deviceID)
+}
+
+func (s *Sharder) owner(deviceID int32) string {
+	var (
+		owner string
+		best  uint64
+	)
+	for _, member := range s.members {
+		if score := rendezvousScore(deviceID, member); owner == "" || score > best {
+			owner, best = member, score
+		}
+	}
+	return owner
+}
+
+// Filter returns devices owned by this instance and logs devices gained or
+// lost since the previous call.
+func (s *Sharder) Filter(devices []models.Device) []models.Device {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// without members, e.g. fenced from the cluster, nothing is owned
+	share := len(devices)
+	if len(s.members) > 0 {
+		share = len(devices)/len(s.members) + 1
+	}
+	owned := make(map[int32]bool, share)
+	kept := make([]models.Device, 0, share)
+	var gained []int32
+	for _, dev := range devices {
+		if s.owner(dev.DeviceID) != s.self {
+			continue
+		}
+		owned[dev.DeviceID] = true
+		kept = append(kept, dev)
+		if s.owned != nil && !s.owned[dev.DeviceID] {
+			gained = append(gained, dev.DeviceID)
+		}
+	}
+
+	// devices deleted from LibreNMS are not ownership changes
+	listed := make(map[int32]bool, len(devices))
+	for _, dev := range devices {
+		listed[dev.DeviceID] = true
+	}
+	var lost []int32
+	for id := range s.owned {
+		if !owned[id] && listed[id] {
+			lost = append(lost, id)
+		}
+	}
+	if len(gained) > 0 || len(lost) > 0 {
+		sort.Slice(lost, func(i, j int) bool { return lost[i] < lost[j] })
+		s.logger.Info("device ownership changed", zap.String("member", s.self), zap.Strings("members", s.members), zap.Int32s("gained", gained), zap.Int32s("lost", lost))
+	}
+	s.owned = owned
+	return kept
+}
+
+func rendezvousScore(deviceID int32, member string) uint64 {
+	h := fnv.New64a()
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], uint32(deviceID))
+	h.Write(id[:])
+	h.Write([]byte(member))
+	// fnv mixes the last bytes poorly, finalise like splitmix64
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
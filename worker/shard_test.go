@@ -0,0 +1,69 @@
+package worker
+
+import (
+	"math"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+const shardTestDevices = 20000
+
+func owners(t *testing.T, count int) map[int32]string {
+	t.Helper()
+	sharder, err := NewSharder(zap.NewNop(), count, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := make(map[int32]string, shardTestDevices)
+	for id := int32(1); id <= shardTestDevices; id++ {
+		owners[id] = sharder.Owner(id)
+	}
+	return owners
+}
+
+func TestSharderDistributesEvenly(t *testing.T) {
+	for _, count := range []int{2, 3, 5, 8} {
+		perMember := map[string]int{}
+		for _, owner := range owners(t, count) {
+			perMember[owner]++
+		}
+		if len(perMember) != count {
+			t.Fatalf("%d shards: devices went to %d members", count, len(perMember))
+		}
+		want := float64(shardTestDevices) / float64(count)
+		for member, n := range perMember {
+			// hashing is deterministic, the tolerance covers its variance
+			if math.Abs(float64(n)-want)/want > 0.1 {
+				t.Errorf("%d shards: member %s owns %d devices, want about %.0f", count, member, n, want)
+			}
+		}
+	}
+}
+
+func TestSharderMovesFewDevices(t *testing.T) {
+	for count := 1; count < 8; count++ {
+		before, after := owners(t, count), owners(t, count+1)
+		moved := 0
+		for id, owner := range before {
+			if after[id] == owner {
+				continue
+			}
+			moved++
+			// a device only moves to the new member
+			if want := after[id]; want != shardName(count) {
+				t.Fatalf("%d to %d shards: device %d moved from %s to %s", count, count+1, id, owner, want)
+			}
+		}
+		// about 1/n of devices move to the new member
+		want := float64(shardTestDevices) / float64(count+1)
+		if math.Abs(float64(moved)-want)/want > 0.1 {
+			t.Errorf("%d to %d shards: %d devices moved, want about %.0f", count, count+1, moved, want)
+		}
+	}
+}
+
+func shardName(index int) string {
+	sharder, _ := NewSharder(zap.NewNop(), index+1, index)
+	return sharder.self
+}